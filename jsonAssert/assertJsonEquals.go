@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/tonnerre/golang-pretty"
@@ -27,34 +28,22 @@ func Instance() JsonAssert {
 // param 2: actualJson, means the JSON that you are testing.
 // param 3: (Optional) is an array of ignore paths. In other words, you will writedown all the json paths that must be ignored in your test assertion, ex /Time
 func (self *assertJsonImpl) AssertJsonEquals(expectedJson, actualJson []byte, ignorePaths ...string) (err error) {
-	var equal bool
-	var msg []string
 	var expected interface{}
 	var actual interface{}
 
-	if okExpected := json.Unmarshal(expectedJson, &expected); okExpected != nil {
-		err = okExpected
-		equal = false
-		msg[0] = err.Error()
+	if err = json.Unmarshal(expectedJson, &expected); err != nil {
+		return
 	}
 
-	if okActual := json.Unmarshal(actualJson, &actual); okActual != nil {
-		err = okActual
-		equal = false
-		msg[0] = err.Error()
+	if err = json.Unmarshal(actualJson, &actual); err != nil {
+		return
 	}
 
-	expectedAsMap := expected.(map[string]interface{})
-	actualAsMap := actual.(map[string]interface{})
-
-	equal = reflect.DeepEqual(expectedAsMap, actualAsMap)
-	if !equal {
-		msg = pretty.Diff(expectedAsMap, actualAsMap)
-	}
-
-	if err == nil && !equal {
+	if !reflect.DeepEqual(expected, actual) {
+		msg := pretty.Diff(expected, actual)
+		sort.Strings(msg)
 		if msgWithIgnorePathsExcluded := self.removeIgnorePaths(msg, ignorePaths); len(msgWithIgnorePathsExcluded) > 0 {
-			err = fmt.Errorf("Json not equal. Fields " + strings.Join(msgWithIgnorePathsExcluded, ","))
+			err = fmt.Errorf("Json not equal. Fields %s", strings.Join(msgWithIgnorePathsExcluded, ","))
 		}
 	}
 
@@ -76,6 +76,25 @@ func (self *jsonAssertSuite) TestAssertJsonEqualsWithIgnore() {
 
 }
 
+func (self *jsonAssertSuite) TestAssertJsonEqualsInvalidJSON() {
+	expected := []byte(`{"Name":"Alice"}`)
+	actual := []byte(`{"Name":`)
+
+	self.Error(self.jsonAssert.AssertJsonEquals(expected, actual))
+	self.Error(self.jsonAssert.AssertJsonEquals(actual, expected))
+}
+
+func (self *jsonAssertSuite) TestAssertJsonEqualsArray() {
+	expected := []byte(`[{"Name":"Alice"},{"Name":"Bob"}]`)
+	actual := []byte(`[ {"Name":"Alice"}, {"Name":"Bob"} ]`)
+
+	if err := self.jsonAssert.AssertJsonEquals(expected, actual); err != nil {
+		self.Fail("Unexpected error", err.Error())
+	}
+
+	self.Error(self.jsonAssert.AssertJsonEquals(expected, []byte(`[{"Name":"Bob"},{"Name":"Alice"}]`)))
+}
+
 func TestJsonAssertSuite(t *testing.T) {
 	testSuit := new(jsonAssertSuite)
 	testSuit.jsonAssert = Instance()
@@ -1,6 +1,305 @@
 package main
 
-//Example of usage
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pjgg/rest-in-peace/mockServer"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: rest-in-peace serve [flags]
+
+Start a mock server as a standalone process, serving the stub files of a directory.
+Every flag can also be set with an environment variable, ex REST_IN_PEACE_PORT=9090 for -port,
+or in a YAML or JSON config file given with -config, ex port: 9090
+The flags win over the environment variables, and both win over the config file.
+
+Flags:
+`
+
+// envPrefix is the prefix of the environment variables that set the flags, ex REST_IN_PEACE_STUBS for -stubs
+const envPrefix = "REST_IN_PEACE_"
+
+// serveConfig are the settings of the serve command.
+type serveConfig struct {
+	config          string
+	port            int
+	bind            string
+	stubs           string
+	watch           time.Duration
+	tls             bool
+	tlsCert         string
+	tlsKey          string
+	tlsHostnames    string
+	caCertOut       string
+	http2           bool
+	unmatched       string
+	defaultStatus   int
+	defaultBody     string
+	upstream        string
+	recordings      string
+	playbackMode    string
+	shutdownTimeout time.Duration
+}
+
 func main() {
+	if len(os.Args) < 2 || os.Args[1] != "serve" {
+		fmt.Fprint(os.Stderr, usage)
+		newFlagSet(new(serveConfig), os.Stderr).PrintDefaults()
+		os.Exit(2)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	err := serve(os.Args[2:], signals)
+	switch {
+	case err == flag.ErrHelp:
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// serve run the serve command until a signal is received, and then shutdown the mock server gracefully.
+func serve(args []string, signals <-chan os.Signal) error {
+	config, err := parseServeConfig(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+	server, err := newMockServer(config)
+	if err != nil {
+		return err
+	}
+	if err = server.Start(); err != nil {
+		server.Close()
+		return err
+	}
+
+	received := <-signals
+	fmt.Printf("Mock server received %s, shutting down\n", received)
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+func newFlagSet(config *serveConfig, output io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprint(output, usage)
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&config.config, "config", "", "YAML or JSON file with the settings, ex port: 9090, the keys are the flag names")
+	flags.IntVar(&config.port, "port", 8080, "port to listen on, 0 for an ephemeral one")
+	flags.StringVar(&config.bind, "bind", "", "address to listen on, ex 127.0.0.1, all the interfaces if empty")
+	flags.StringVar(&config.stubs, "stubs", "", "stub file or directory to load, see the stub files format")
+	flags.DurationVar(&config.watch, "watch", time.Second, "interval to poll the stubs directory for changes, 0 loads it only once")
+	flags.BoolVar(&config.tls, "tls", false, "serve https with a certificate signed by a CA generated on the fly")
+	flags.StringVar(&config.tlsCert, "tls-cert", "", "PEM certificate file to serve https with, needs -tls-key")
+	flags.StringVar(&config.tlsKey, "tls-key", "", "PEM key file of -tls-cert")
+	flags.StringVar(&config.tlsHostnames, "tls-hostnames", "", "comma separated hostnames of the generated certificate (default localhost,127.0.0.1,::1)")
+	flags.StringVar(&config.caCertOut, "ca-cert-out", "", "file to write the PEM CA to, so the clients can trust the mock server")
+	flags.BoolVar(&config.http2, "http2", false, "serve HTTP/2, over TLS or h2c")
+	flags.StringVar(&config.unmatched, "unmatched", "notfound", "policy for the unmatched requests: notfound, default, record or playback")
+	flags.IntVar(&config.defaultStatus, "default-status", 200, "status of the default unmatched response")
+	flags.StringVar(&config.defaultBody, "default-body", "", "body of the default unmatched response")
+	flags.StringVar(&config.upstream, "upstream", "", "base URL that the record policy forwards the unmatched requests to")
+	flags.StringVar(&config.recordings, "recordings", "", "directory of the recordings, written by record and served by playback")
+	flags.StringVar(&config.playbackMode, "playback-mode", "strict", "strict serves only the recordings, lenient falls through to the stubs")
+	flags.DurationVar(&config.shutdownTimeout, "shutdown-timeout", 10*time.Second, "time to wait for the active requests on SIGINT or SIGTERM")
+	return flags
+}
+
+// parseServeConfig read the settings from args, then the ones not given as flags from the environment variables, and then the rest from the config file.
+func parseServeConfig(args []string, output io.Writer) (*serveConfig, error) {
+	config := new(serveConfig)
+	flags := newFlagSet(config, output)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %s", strings.Join(flags.Args(), " "))
+	}
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	environment := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && !given[f.Name] {
+			environment[f.Name] = value
+		}
+	})
+	if value, ok := environment["config"]; ok {
+		config.config = value
+	}
+
+	if config.config != "" {
+		settings, err := readConfigFile(config.config)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range settings {
+			if name == "config" || flags.Lookup(name) == nil {
+				return nil, fmt.Errorf("unknown setting %s in %s", name, config.config)
+			}
+			if given[name] {
+				continue
+			}
+			if err := flags.Set(name, value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s in %s: %s", value, name, config.config, err.Error())
+			}
+		}
+	}
+
+	for name, value := range environment {
+		if err := flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %s", value, envName(name), err.Error())
+		}
+	}
+
+	return config, nil
+}
+
+// envName return the environment variable of a flag, ex REST_IN_PEACE_TLS_CERT for -tls-cert
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// readConfigFile read a YAML or JSON object of settings, its keys are the flag names and its values the flag values, ex port: 9090
+func readConfigFile(file string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Mock server can't read its config %s: %s", file, err.Error())
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("Mock server can't read its config %s: %s", file, err.Error())
+	}
+	settings := make(map[string]string, len(values))
+	for name, value := range values {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			return nil, fmt.Errorf("invalid value for %s in %s, expected a string, number or boolean", name, file)
+		}
+		settings[name] = fmt.Sprint(value)
+	}
+
+	return settings, nil
+}
+
+// newMockServer build the mock server defined by config, not started yet.
+func newMockServer(config *serveConfig) (mockServer.MockServerBehavior, error) {
+	server := mockServer.New(config.port)
+	if err := server.SetHost(config.bind); err != nil {
+		return nil, err
+	}
+
+	if err := enableTLS(server, config); err != nil {
+		return nil, err
+	}
+	if config.http2 {
+		if err := server.EnableHTTP2(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case config.stubs != "" && config.watch > 0:
+		if err := server.WatchStubs(config.stubs, config.watch); err != nil {
+			return nil, err
+		}
+	case config.stubs != "":
+		if err := server.LoadStubs(config.stubs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := onUnmatched(server, config); err != nil {
+		server.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+func enableTLS(server mockServer.MockServerBehavior, config *serveConfig) error {
+	switch {
+	case config.tlsCert != "" || config.tlsKey != "":
+		if config.tlsCert == "" || config.tlsKey == "" {
+			return errors.New("-tls-cert and -tls-key must be used together")
+		}
+		if err := server.EnableTLSFromFiles(config.tlsCert, config.tlsKey); err != nil {
+			return err
+		}
+	case config.tls:
+		var hostnames []string
+		if config.tlsHostnames != "" {
+			for _, hostname := range strings.Split(config.tlsHostnames, ",") {
+				hostnames = append(hostnames, strings.TrimSpace(hostname))
+			}
+		}
+		if err := server.EnableTLS(hostnames...); err != nil {
+			return err
+		}
+	case config.caCertOut != "":
+		return errors.New("-ca-cert-out needs -tls or -tls-cert")
+	default:
+		return nil
+	}
+
+	if config.caCertOut != "" {
+		if err := ioutil.WriteFile(config.caCertOut, server.CACertPEM(), 0644); err != nil {
+			return fmt.Errorf("Mock server can't write its CA to %s: %s", config.caCertOut, err.Error())
+		}
+	}
+	return nil
+}
+
+func onUnmatched(server mockServer.MockServerBehavior, config *serveConfig) error {
+	switch config.unmatched {
+	case "notfound":
+	case "default":
+		server.OnUnmatched(mockServer.DefaultResponse([]byte(config.defaultBody), config.defaultStatus))
+	case "record":
+		upstream, err := url.Parse(config.upstream)
+		if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+			return fmt.Errorf("-unmatched record needs an absolute -upstream URL, but was %q", config.upstream)
+		}
+		if config.recordings == "" {
+			return errors.New("-unmatched record needs a -recordings directory")
+		}
+		server.OnUnmatched(mockServer.Record(config.upstream, config.recordings))
+	case "playback":
+		if config.recordings == "" {
+			return errors.New("-unmatched playback needs a -recordings directory")
+		}
+		mode := mockServer.Strict
+		switch config.playbackMode {
+		case "strict":
+		case "lenient":
+			mode = mockServer.Lenient
+		default:
+			return fmt.Errorf("unknown -playback-mode %q, expected strict or lenient", config.playbackMode)
+		}
+		return server.Playback(config.recordings, mode)
+	default:
+		return fmt.Errorf("unknown -unmatched policy %q, expected notfound, default, record or playback", config.unmatched)
+	}
 
+	return nil
 }
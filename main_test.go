@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "status.yaml"), []byte("request: {method: GET, path: /v1/status}\nresponse: {body: up}\n"), 0644)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	baseURL := "http://127.0.0.1:" + strconv.Itoa(port)
+
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve([]string{"-port", strconv.Itoa(port), "-bind", "127.0.0.1", "-stubs", dir, "-unmatched", "default", "-default-status", "418"}, signals)
+	}()
+
+	var resp *http.Response
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = http.Get(baseURL + "/v1/status"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "up", string(body))
+
+	if resp, err = http.Get(baseURL + "/v1/users"); assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 418, resp.StatusCode)
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case err = <-served:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after SIGTERM")
+	}
+	_, err = http.Get(baseURL + "/v1/status")
+	assert.Error(t, err)
+}
+
+func TestServeConfig(t *testing.T) {
+	os.Setenv("REST_IN_PEACE_PORT", "9090")
+	os.Setenv("REST_IN_PEACE_PLAYBACK_MODE", "lenient")
+	defer os.Unsetenv("REST_IN_PEACE_PORT")
+	defer os.Unsetenv("REST_IN_PEACE_PLAYBACK_MODE")
+
+	config, err := parseServeConfig([]string{"-playback-mode", "strict"}, ioutil.Discard)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 9090, config.port)
+		assert.Equal(t, "strict", config.playbackMode, "the flags must win over the environment")
+		assert.Equal(t, "notfound", config.unmatched)
+	}
+
+	configFile := filepath.Join(t.TempDir(), "rest-in-peace.yaml")
+	ioutil.WriteFile(configFile, []byte("port: 7070\nbind: 127.0.0.1\nwatch: 5s\ntls: true\nunmatched: default\nplayback-mode: strict\n"), 0644)
+	config, err = parseServeConfig([]string{"-config", configFile, "-unmatched", "notfound"}, ioutil.Discard)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 9090, config.port, "the environment must win over the config file")
+		assert.Equal(t, "lenient", config.playbackMode, "the environment must win over the config file")
+		assert.Equal(t, "notfound", config.unmatched, "the flags must win over the config file")
+		assert.Equal(t, "127.0.0.1", config.bind)
+		assert.Equal(t, 5*time.Second, config.watch)
+		assert.True(t, config.tls)
+	}
+	ioutil.WriteFile(configFile, []byte("prot: 7070\n"), 0644)
+	_, err = parseServeConfig([]string{"-config", configFile}, ioutil.Discard)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown setting prot")
+	}
+	_, err = parseServeConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, ioutil.Discard)
+	assert.Error(t, err)
+
+	_, err = parseServeConfig([]string{"-h"}, ioutil.Discard)
+	assert.Equal(t, flag.ErrHelp, err)
+
+	_, err = parseServeConfig([]string{"extra"}, ioutil.Discard)
+	assert.Error(t, err)
+
+	invalidConfigs := map[string][]string{
+		"unknown -unmatched policy": {"-unmatched", "drop"},
+		"absolute -upstream URL":    {"-unmatched", "record", "-upstream", "api.github.com", "-recordings", t.TempDir()},
+		"needs a -recordings":       {"-unmatched", "playback"},
+		"must be used together":     {"-tls-cert", "cert.pem"},
+		"-ca-cert-out needs":        {"-ca-cert-out", "ca.pem"},
+		"missing":                   {"-stubs", filepath.Join(t.TempDir(), "missing")},
+		"unknown -playback-mode":    {"-unmatched", "playback", "-recordings", t.TempDir(), "-playback-mode", "loose"},
+	}
+	for message, args := range invalidConfigs {
+		config, err := parseServeConfig(args, ioutil.Discard)
+		if !assert.Nil(t, err, message) {
+			continue
+		}
+		_, err = newMockServer(config)
+		if assert.Error(t, err, message) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	config, _ = parseServeConfig([]string{"-tls", "-ca-cert-out", caCert}, ioutil.Discard)
+	server, err := newMockServer(config)
+	if assert.Nil(t, err) {
+		assert.Contains(t, server.URL(), "https://")
+		content, _ := ioutil.ReadFile(caCert)
+		assert.Equal(t, server.CACertPEM(), content)
+	}
+
+	config, _ = parseServeConfig([]string{"-port", "0", "-tls", "-tls-hostnames", "127.0.0.1, localhost"}, ioutil.Discard)
+	server, err = newMockServer(config)
+	if assert.Nil(t, err) && assert.Nil(t, server.Start()) {
+		defer server.Close()
+		resp, err := server.Client().Get(server.URL())
+		if assert.Nil(t, err, "the hostnames must be trimmed") {
+			assert.Equal(t, 404, resp.StatusCode)
+		}
+	}
+}
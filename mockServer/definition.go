@@ -0,0 +1,344 @@
+package mockServer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// StubDefinition is a stub saved in a file, the format of the stub files and of the recordings. See LoadStubs.
+type StubDefinition struct {
+	Request  RequestDefinition  `json:"request"`
+	Response ResponseDefinition `json:"response"`
+}
+
+// RequestDefinition is the precondition of a StubDefinition, the request that the stub answers. Path is an exact path, PathPattern a regular expression or a path template as in When. Both are matched against the path only, the query string is matched by Query.
+type RequestDefinition struct {
+	Method      string                       `json:"method"`
+	Path        string                       `json:"path,omitempty"`
+	PathPattern string                       `json:"pathPattern,omitempty"`
+	Query       map[string]MatcherDefinition `json:"query,omitempty"`
+	Headers     map[string]MatcherDefinition `json:"headers,omitempty"`
+	Body        *MatcherDefinition           `json:"body,omitempty"`
+	JSONBody    json.RawMessage              `json:"jsonBody,omitempty"`
+	IgnorePaths []string                     `json:"ignorePaths,omitempty"`
+	BodyBase64  []byte                       `json:"bodyBase64,omitempty"`
+}
+
+// ResponseDefinition is the response of a StubDefinition, 200 if no status is defined. BodyFile is a file with the body, relative to the stub file.
+type ResponseDefinition struct {
+	Status  int                   `json:"status,omitempty"`
+	Headers map[string]StringList `json:"headers,omitempty"`
+	BodyDefinition
+	BodyFile string `json:"bodyFile,omitempty"`
+}
+
+// BodyDefinition is a response body. Only one field is set: JSONBody for JSON payloads, so they are readable and editable, Body for the rest of text payloads and BodyBase64 for binary ones.
+type BodyDefinition struct {
+	Body       string          `json:"body,omitempty"`
+	JSONBody   json.RawMessage `json:"jsonBody,omitempty"`
+	BodyBase64 []byte          `json:"bodyBase64,omitempty"`
+}
+
+// MatcherDefinition is a Matcher in a stub file. A string means equal to, a list of strings means Values, otherwise it is an object with one of its fields, ex {"matches": "^Bearer "}
+type MatcherDefinition struct {
+	EqualTo           *string  `json:"equalTo,omitempty"`
+	EqualToIgnoreCase *string  `json:"equalToIgnoreCase,omitempty"`
+	Matches           *string  `json:"matches,omitempty"`
+	Contains          *string  `json:"contains,omitempty"`
+	Present           bool     `json:"present,omitempty"`
+	Absent            bool     `json:"absent,omitempty"`
+	Values            []string `json:"values,omitempty"`
+}
+
+// StringList is a list of strings in a stub file, a single string is a list of one.
+type StringList []string
+
+type matcherDefinition MatcherDefinition
+
+// MarshalJSON ... the short forms are used when possible, a string for equal to and a list for Values.
+func (definition MatcherDefinition) MarshalJSON() ([]byte, error) {
+	others := definition.EqualToIgnoreCase != nil || definition.Matches != nil || definition.Contains != nil || definition.Present || definition.Absent
+	switch {
+	case others:
+		return json.Marshal(matcherDefinition(definition))
+	case definition.Values != nil && definition.EqualTo == nil:
+		return json.Marshal(definition.Values)
+	case definition.EqualTo != nil && definition.Values == nil:
+		return json.Marshal(*definition.EqualTo)
+	default:
+		return json.Marshal(matcherDefinition(definition))
+	}
+}
+
+// UnmarshalJSON ... accept the short forms, a string, number or boolean for equal to and a list for Values.
+func (definition *MatcherDefinition) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		return json.Unmarshal(data, (*matcherDefinition)(definition))
+	case len(data) > 0 && data[0] == '[':
+		var values StringList
+		err := json.Unmarshal(data, &values)
+		*definition = MatcherDefinition{Values: values}
+		return err
+	default:
+		value, err := scalarString(data)
+		*definition = MatcherDefinition{EqualTo: &value}
+		return err
+	}
+}
+
+// UnmarshalJSON ... accept a single string, number or boolean as a list of one.
+func (list *StringList) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var values []json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		*list = make(StringList, len(values))
+		for i, value := range values {
+			var err error
+			if (*list)[i], err = scalarString(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	value, err := scalarString(data)
+	*list = StringList{value}
+	return err
+}
+
+// scalarString return a JSON string, or the text of a JSON number or boolean, so page: 2 means "2"
+func scalarString(data []byte) (value string, err error) {
+	if len(data) > 0 && data[0] == '"' {
+		err = json.Unmarshal(data, &value)
+		return
+	}
+
+	var scalar interface{}
+	if err = json.Unmarshal(data, &scalar); err != nil {
+		return
+	}
+	switch scalar.(type) {
+	case float64, bool:
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("expected a string but was %s", data)
+	}
+}
+
+// matcher build the Matcher of the definition, only one of its fields must be set.
+func (definition MatcherDefinition) matcher() (matcher Matcher, err error) {
+	set := 0
+	if definition.EqualTo != nil {
+		set++
+		matcher = EqualTo(*definition.EqualTo)
+	}
+	if definition.EqualToIgnoreCase != nil {
+		set++
+		matcher = EqualToIgnoreCase(*definition.EqualToIgnoreCase)
+	}
+	if definition.Matches != nil {
+		set++
+		if _, err = regexp.Compile(*definition.Matches); err != nil {
+			return
+		}
+		matcher = Matches(*definition.Matches)
+	}
+	if definition.Contains != nil {
+		set++
+		matcher = Contains(*definition.Contains)
+	}
+	if definition.Present {
+		set++
+		matcher = Present()
+	}
+	if definition.Absent {
+		set++
+		matcher = Absent()
+	}
+	if definition.Values != nil {
+		set++
+		matcher = Values(definition.Values...)
+	}
+
+	if set != 1 {
+		return nil, fmt.Errorf("a matcher needs exactly one of %s", strings.Join(matcherFields, ", "))
+	}
+	return
+}
+
+func newBodyDefinition(body []byte) (definition BodyDefinition) {
+	switch {
+	case len(body) == 0:
+	case json.Valid(body):
+		definition.JSONBody = json.RawMessage(body)
+	case utf8.Valid(body):
+		definition.Body = string(body)
+	default:
+		definition.BodyBase64 = body
+	}
+
+	return
+}
+
+// newRequestDefinition describe a received request as the recordings save it: its exact path, its query params and its body.
+func newRequestDefinition(r *http.Request, body []byte) RequestDefinition {
+	definition := RequestDefinition{
+		Method: r.Method,
+		Path:   r.URL.Path,
+	}
+	for name, values := range r.URL.Query() {
+		if definition.Query == nil {
+			definition.Query = make(map[string]MatcherDefinition)
+		}
+		definition.Query[name] = MatcherDefinition{Values: values}
+	}
+
+	bodyDefinition := newBodyDefinition(body)
+	definition.JSONBody = bodyDefinition.JSONBody
+	definition.BodyBase64 = bodyDefinition.BodyBase64
+	if bodyDefinition.Body != "" {
+		definition.Body = &MatcherDefinition{EqualTo: &bodyDefinition.Body}
+	}
+
+	return definition
+}
+
+// bytes return the body payload. JSON bodies are compacted, so a recorded body is returned as it was received even if its file was indented.
+func (definition BodyDefinition) bytes() []byte {
+	switch {
+	case len(definition.JSONBody) > 0:
+		return compactJSON(definition.JSONBody)
+	case definition.Body != "":
+		return []byte(definition.Body)
+	default:
+		return definition.BodyBase64
+	}
+}
+
+func compactJSON(body json.RawMessage) []byte {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, body); err != nil {
+		return body
+	}
+
+	return compacted.Bytes()
+}
+
+// stub build the stub of the definition, dir is the directory of its file.
+func (definition StubDefinition) stub(dir string) (*stubReturn, error) {
+	stub, err := definition.Request.stub()
+	if err != nil {
+		return nil, err
+	}
+	response, err := definition.Response.stubResponse(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stub.thenResponse(response)
+	return stub, nil
+}
+
+func (definition RequestDefinition) stub() (stub *stubReturn, err error) {
+	method, err := parseHTTPMethod(definition.Method)
+	if err != nil {
+		return
+	}
+
+	pathExpr := definition.PathPattern
+	if pathExpr == "" {
+		pathExpr = "^" + regexp.QuoteMeta(definition.Path) + "$"
+	}
+	if err = recovered(func() { stub = newStubReturn(method, pathExpr) }); err != nil {
+		return
+	}
+	stub.pathOnly = true
+
+	for name, matcherDefinition := range definition.Query {
+		var matcher Matcher
+		if matcher, err = matcherDefinition.matcher(); err != nil {
+			return nil, fmt.Errorf("query %s: %s", name, err.Error())
+		}
+		stub.WithQueryParam(name, matcher)
+	}
+	for name, matcherDefinition := range definition.Headers {
+		var matcher Matcher
+		if matcher, err = matcherDefinition.matcher(); err != nil {
+			return nil, fmt.Errorf("header %s: %s", name, err.Error())
+		}
+		stub.WithHeaderMatcher(name, matcher)
+	}
+
+	switch {
+	case definition.Body != nil:
+		var matcher Matcher
+		if matcher, err = definition.Body.matcher(); err != nil {
+			return nil, fmt.Errorf("body: %s", err.Error())
+		}
+		stub.WithBody(matcher)
+	case len(definition.JSONBody) > 0:
+		stub.WithJSONBody(compactJSON(definition.JSONBody), definition.IgnorePaths...)
+	case len(definition.BodyBase64) > 0:
+		stub.WithBody(EqualTo(string(definition.BodyBase64)))
+	}
+
+	return
+}
+
+func (definition ResponseDefinition) stubResponse(dir string) (*stubResponse, error) {
+	response := &stubResponse{
+		thenReturn: definition.bytes(),
+		status:     definition.Status,
+		headers:    make(http.Header),
+	}
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	for name, values := range definition.Headers {
+		for _, value := range values {
+			response.headers.Add(name, value)
+		}
+	}
+
+	if definition.BodyFile != "" {
+		var err error
+		if response.thenReturn, err = ioutil.ReadFile(relativeTo(dir, definition.BodyFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// relativeTo resolve a file of a stub definition, relative paths are relative to the directory of the stub file.
+func relativeTo(dir string, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+
+	return filepath.Join(dir, file)
+}
+
+// recovered run f and return its panic as an error, for the builders that panic on an invalid expression, as regexp.MustCompile does.
+func recovered(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	f()
+	return
+}
@@ -0,0 +1,95 @@
+package mockServer
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// z99 is the standard normal quantile of the 99th percentile.
+const z99 = 2.326348
+
+// Delay return how long the MockServer waits before answering a request. See FixedDelay, RandomDelay and LogNormalDelay.
+type Delay func() time.Duration
+
+// FixedDelay always wait d.
+func FixedDelay(d time.Duration) Delay {
+	return func() time.Duration {
+		return d
+	}
+}
+
+// RandomDelay wait a uniformly distributed time between min and max.
+func RandomDelay(min, max time.Duration) Delay {
+	return func() time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rand.Int63n(int64(max-min)))
+	}
+}
+
+// LogNormalDelay wait a log-normal distributed time, the usual shape of real services latency, defined by its median (50th percentile) and its 99th percentile.
+func LogNormalDelay(median, p99 time.Duration) Delay {
+	mu := math.Log(float64(median))
+	sigma := 0.0
+	if p99 > median {
+		sigma = (math.Log(float64(p99)) - mu) / z99
+	}
+	return func() time.Duration {
+		return time.Duration(math.Exp(mu + sigma*rand.NormFloat64()))
+	}
+}
+
+// wait sleeps the delay, or less if the client cancels the request. It return false if the request was cancelled, so there is no one waiting for the response.
+func wait(r *http.Request, delay Delay) bool {
+	if delay == nil {
+		return true
+	}
+
+	d := delay()
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// DefaultDelay define the delay of every stub without its own delay, nil means no delay.
+func (mockServer *MockServer) DefaultDelay(delay Delay) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.defaultDelay = delay
+}
+
+// WithDelay is used in order to answer after d, useful to test your client timeouts.
+func (mockServer *stubReturn) WithDelay(d time.Duration) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.delay = FixedDelay(d)
+	return mockServer
+}
+
+// WithRandomDelay is used in order to answer after a random time between min and max.
+func (mockServer *stubReturn) WithRandomDelay(min, max time.Duration) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.delay = RandomDelay(min, max)
+	return mockServer
+}
+
+// WithLogNormalDelay is used in order to answer after a log-normal distributed time, with the given median and 99th percentile, ex WithLogNormalDelay(20*time.Millisecond, 300*time.Millisecond)
+func (mockServer *stubReturn) WithLogNormalDelay(median, p99 time.Duration) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.delay = LogNormalDelay(median, p99)
+	return mockServer
+}
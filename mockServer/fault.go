@@ -0,0 +1,78 @@
+package mockServer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// Fault is a connection level failure, produced by hijacking the connection of the request.
+type Fault int
+
+const (
+	// ConnectionReset ... the connection is closed with a TCP reset, the client gets a "connection reset by peer".
+	ConnectionReset Fault = 1 + iota
+	// EmptyResponse ... the connection is closed without sending a single byte.
+	EmptyResponse
+	// ClosedBeforeHeaders ... the connection is closed after the status line, before the end of the headers.
+	ClosedBeforeHeaders
+	// TruncatedBody ... the Content-Length header is larger than the body sent before closing the connection.
+	TruncatedBody
+	// MalformedResponse ... garbage bytes are sent instead of a status line.
+	MalformedResponse
+)
+
+var fault = [...]string{
+	"ConnectionReset",
+	"EmptyResponse",
+	"ClosedBeforeHeaders",
+	"TruncatedBody",
+	"MalformedResponse",
+}
+
+func (kind Fault) String() string {
+	return fault[kind-1]
+}
+
+// serveFault hijack the connection in order to produce the fault. When the connection can't be hijacked, ex HTTP/2, the response is aborted.
+func serveFault(w http.ResponseWriter, kind Fault) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	defer conn.Close()
+
+	switch kind {
+	case ConnectionReset:
+		resetConnection(conn)
+		return
+	case ClosedBeforeHeaders:
+		buffer.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/js")
+	case TruncatedBody:
+		buffer.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 1024\r\n\r\n{\"key\":\"hello\",\"val")
+	case MalformedResponse:
+		buffer.WriteString("\x00\x13\x37 rest in peace \xff\xfe\r\n\r\n")
+	}
+	buffer.Flush()
+}
+
+// resetConnection close the TCP connection with a reset. Over TLS the TCP connection is closed directly, so no close_notify alert reaches the client before the reset.
+func resetConnection(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// ThenFault is the action that will break the connection for a given precondition, ex ThenReturn(nil, 503).ThenFault(ConnectionReset).ThenReturn(body, 200)
+func (mockServer *stubReturn) ThenFault(kind Fault) StubReturn {
+	return mockServer.thenResponse(&stubResponse{fault: kind})
+}
@@ -0,0 +1,70 @@
+package mockServer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// HTTP1 ... the protocol of the HTTP/1.1 requests, as recorded in the journal.
+	HTTP1 = "HTTP/1.1"
+	// HTTP2 ... the protocol of the HTTP/2 requests, over TLS or cleartext (h2c), as recorded in the journal.
+	HTTP2 = "HTTP/2.0"
+)
+
+// EnableHTTP2 ... the MockServer will also serve HTTP/2, negotiated through ALPN when TLS is enabled, or as cleartext h2c with prior knowledge otherwise. HTTP/1.1 clients are still served. Call it before Start, once started it returns an error.
+// Faults can't hijack an HTTP/2 connection, over HTTP/2 they just abort the stream.
+func (mockServer *MockServer) EnableHTTP2() error {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	if mockServer.listener != nil {
+		return errors.New("Mock server can't enable HTTP/2 once started, call it before Start")
+	}
+
+	mockServer.http2 = true
+	return nil
+}
+
+// protocols return the protocols served by the MockServer, and spoken by its Client.
+func (mockServer *MockServer) protocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if mockServer.http2 {
+		if mockServer.tlsConfig != nil {
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	return protocols
+}
+
+// clientProtocols return the protocols of the Client, HTTP/2 only when the MockServer serves it, so the Client never falls back to HTTP/1.1 silently.
+func (mockServer *MockServer) clientProtocols() *http.Protocols {
+	if !mockServer.http2 {
+		return mockServer.protocols()
+	}
+
+	protocols := mockServer.protocols()
+	protocols.SetHTTP1(false)
+	return protocols
+}
+
+// checkProtocol return why the request protocol doesn't match the stub one.
+func (mockServer *MockServer) checkProtocol(r *http.Request, stub *stubReturn) (failure string) {
+	if stub.protocol != "" && r.Proto != stub.protocol {
+		failure = fmt.Sprintf("protocol expected %s but was %s", stub.protocol, r.Proto)
+	}
+
+	return
+}
+
+// WithProtocol is used in order to add a protocol precondition, ex WithProtocol(HTTP2) only matches the requests of a client that really talks HTTP/2.
+func (mockServer *stubReturn) WithProtocol(protocol string) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.protocol = protocol
+	return mockServer
+}
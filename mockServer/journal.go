@@ -0,0 +1,193 @@
+package mockServer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordedRequest is a request received by the MockServer, with the stub that served it.
+type RecordedRequest struct {
+	Method    string
+	Path      string
+	Header    http.Header
+	Body      []byte
+	Timestamp time.Time
+	// Proto is the protocol of the request, HTTP1 or HTTP2
+	Proto string
+	// RemoteAddr is the client address, requests multiplexed over the same HTTP/2 connection share it.
+	RemoteAddr string
+	// MatchedStub describe the stub that served the request, ex "GET /users/pjgg*". Empty if no stub match.
+	MatchedStub string
+	// PathParams are the values captured by the path template of the matched stub, ex {login}
+	PathParams map[string]string
+	// Mismatches describe the stubs with the same method and path that were discarded, and the query params, headers or body that failed.
+	Mismatches []string
+}
+
+func (recordedRequest RecordedRequest) String() string {
+	matchedStub := "no stub matched"
+	if recordedRequest.MatchedStub != "" {
+		matchedStub = "matched " + recordedRequest.MatchedStub
+	}
+
+	return fmt.Sprintf("%s %s (%s at %s)", recordedRequest.Method, recordedRequest.Path, matchedStub, recordedRequest.Timestamp.Format(time.RFC3339Nano))
+}
+
+// Verification is a Mockito style check over the requests received by the MockServer. Each method return nil when the check succeeds, otherwise an error that list all the received requests.
+type Verification interface {
+	Times(times int) error
+	Never() error
+	AtLeast(times int) error
+}
+
+type journal struct {
+	mutex    sync.Mutex
+	requests []RecordedRequest
+	// generation is increased by clean, so the requests in flight while the journal is cleaned don't update the requests recorded after.
+	generation int
+}
+
+// journalEntry identify a recorded request, its index is only valid in its generation of the journal.
+type journalEntry struct {
+	index      int
+	generation int
+}
+
+type verification struct {
+	httpMethod   HTTPMethod
+	pathExpr     string
+	path         *regexp.Regexp
+	pathTemplate bool
+	journal      *journal
+}
+
+// record store the inbound request in the journal. The request body is read and restored, so it can be read again later.
+func (journal *journal) record(r *http.Request, fullPath string) journalEntry {
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	journal.requests = append(journal.requests, RecordedRequest{
+		Method:     r.Method,
+		Path:       fullPath,
+		Header:     r.Header,
+		Body:       body,
+		Timestamp:  time.Now(),
+		Proto:      r.Proto,
+		RemoteAddr: r.RemoteAddr,
+	})
+
+	return journalEntry{index: len(journal.requests) - 1, generation: journal.generation}
+}
+
+// request return the recorded request of entry, nil if the journal was cleaned while the request was in flight. The journal mutex must be held.
+func (journal *journal) request(entry journalEntry) *RecordedRequest {
+	if entry.generation != journal.generation || entry.index >= len(journal.requests) {
+		return nil
+	}
+
+	return &journal.requests[entry.index]
+}
+
+// matched set the stub that served the recorded request.
+func (journal *journal) matched(entry journalEntry, stub *stubReturn, pathParams map[string]string) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if recordedRequest := journal.request(entry); recordedRequest != nil {
+		recordedRequest.MatchedStub = stub.String()
+		recordedRequest.PathParams = pathParams
+	}
+}
+
+func (journal *journal) mismatched(entry journalEntry, mismatches []string) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if recordedRequest := journal.request(entry); recordedRequest != nil {
+		recordedRequest.Mismatches = mismatches
+	}
+}
+
+func (journal *journal) snapshot() []RecordedRequest {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	requests := make([]RecordedRequest, len(journal.requests))
+	copy(requests, journal.requests)
+
+	return requests
+}
+
+func (journal *journal) clean() {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	journal.requests = nil
+	journal.generation++
+}
+
+// Requests return a copy of all the requests received by the MockServer since the last CleanStub, in arrival order.
+func (mockServer *MockServer) Requests() []RecordedRequest {
+	return mockServer.journal.snapshot()
+}
+
+// Verify ... define which requests should be counted by the Verification. pathExpr is a regular expression evaluated over the request path and query, or a path template evaluated over the path, as in When.
+func (mockServer *MockServer) Verify(httpMethod HTTPMethod, pathExpr string) Verification {
+	path, pathTemplate := compilePathExpr(pathExpr)
+	return &verification{
+		httpMethod:   httpMethod,
+		pathExpr:     pathExpr,
+		path:         path,
+		pathTemplate: pathTemplate,
+		journal:      &mockServer.journal,
+	}
+}
+
+// Times return an error if the expected request was not received exactly the given times.
+func (verification *verification) Times(times int) error {
+	return verification.check(func(count int) bool { return count == times }, fmt.Sprintf("%d times", times))
+}
+
+// Never return an error if the expected request was received.
+func (verification *verification) Never() error {
+	return verification.check(func(count int) bool { return count == 0 }, "0 times")
+}
+
+// AtLeast return an error if the expected request was received less than the given times.
+func (verification *verification) AtLeast(times int) error {
+	return verification.check(func(count int) bool { return count >= times }, fmt.Sprintf("at least %d times", times))
+}
+
+func (verification *verification) check(expected func(count int) bool, expectedMsg string) (err error) {
+	var count int
+	requests := verification.journal.snapshot()
+	for _, recordedRequest := range requests {
+		path := recordedRequest.Path
+		if verification.pathTemplate {
+			path = strings.SplitN(path, "?", 2)[0]
+		}
+		if recordedRequest.Method == verification.httpMethod.String() && verification.path.MatchString(path) {
+			count++
+		}
+	}
+
+	if !expected(count) {
+		received := make([]string, len(requests))
+		for i, recordedRequest := range requests {
+			received[i] = "\t" + recordedRequest.String()
+		}
+		if len(received) == 0 {
+			received = append(received, "\tnone")
+		}
+		err = fmt.Errorf("Expected %s %s to be called %s, but was called %d times. Received requests:\n%s", verification.httpMethod, verification.pathExpr, expectedMsg, count, strings.Join(received, "\n"))
+	}
+
+	return
+}
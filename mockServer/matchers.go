@@ -0,0 +1,138 @@
+package mockServer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Matcher is a precondition over the values received for a query param or a header, values holds all of them and it is empty if the query param or header was not received.
+type Matcher interface {
+	Match(values []string) bool
+	String() string
+}
+
+type matcherFunc struct {
+	match       func(values []string) bool
+	description string
+}
+
+type namedMatcher struct {
+	name    string
+	matcher Matcher
+}
+
+func (matcher *matcherFunc) Match(values []string) bool {
+	return matcher.match(values)
+}
+
+func (matcher *matcherFunc) String() string {
+	return matcher.description
+}
+
+// EqualTo match when any of the received values is equal to value.
+func EqualTo(value string) Matcher {
+	return &matcherFunc{
+		match: func(values []string) bool {
+			for _, received := range values {
+				if received == value {
+					return true
+				}
+			}
+			return false
+		},
+		description: fmt.Sprintf("equal to %q", value),
+	}
+}
+
+// Matches match when any of the received values match the regular expression regexExpr. The expression is not anchored.
+func Matches(regexExpr string) Matcher {
+	expr := regexp.MustCompile(regexExpr)
+	return &matcherFunc{
+		match: func(values []string) bool {
+			for _, received := range values {
+				if expr.MatchString(received) {
+					return true
+				}
+			}
+			return false
+		},
+		description: fmt.Sprintf("matching %q", regexExpr),
+	}
+}
+
+// EqualToIgnoreCase match when any of the received values is equal to value, ignoring the case.
+func EqualToIgnoreCase(value string) Matcher {
+	return &matcherFunc{
+		match: func(values []string) bool {
+			for _, received := range values {
+				if strings.EqualFold(received, value) {
+					return true
+				}
+			}
+			return false
+		},
+		description: fmt.Sprintf("equal to %q ignoring case", value),
+	}
+}
+
+// Contains match when any of the received values contains substr.
+func Contains(substr string) Matcher {
+	return &matcherFunc{
+		match: func(values []string) bool {
+			for _, received := range values {
+				if strings.Contains(received, substr) {
+					return true
+				}
+			}
+			return false
+		},
+		description: fmt.Sprintf("containing %q", substr),
+	}
+}
+
+// Every match when there is at least one received value and every one of them match matcher, ex Every(Matches("^en")).
+func Every(matcher Matcher) Matcher {
+	return &matcherFunc{
+		match: func(values []string) bool {
+			for _, received := range values {
+				if !matcher.Match([]string{received}) {
+					return false
+				}
+			}
+			return len(values) > 0
+		},
+		description: "every value " + matcher.String(),
+	}
+}
+
+// Present match when at least one value was received, even an empty one, ex ?debug
+func Present() Matcher {
+	return &matcherFunc{
+		match:       func(values []string) bool { return len(values) > 0 },
+		description: "present",
+	}
+}
+
+// Absent match when no value was received.
+func Absent() Matcher {
+	return &matcherFunc{
+		match:       func(values []string) bool { return len(values) == 0 },
+		description: "absent",
+	}
+}
+
+// Values match when the received values are exactly the expected ones, in any order, ex ?tag=a&tag=b matches Values("b", "a")
+func Values(expected ...string) Matcher {
+	sortedExpected := append([]string(nil), expected...)
+	sort.Strings(sortedExpected)
+	return &matcherFunc{
+		match: func(values []string) bool {
+			sortedValues := append([]string(nil), values...)
+			sort.Strings(sortedValues)
+			return strings.Join(sortedValues, "\x00") == strings.Join(sortedExpected, "\x00") && len(sortedValues) == len(sortedExpected)
+		},
+		description: fmt.Sprintf("with values %q", expected),
+	}
+}
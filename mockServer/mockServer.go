@@ -1,21 +1,28 @@
 package mockServer
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
+
+	"github.com/pjgg/rest-in-peace/jsonAssert"
 )
 
 var mockServerSingleton sync.Once
-var mockServer MockServer
-
-const portMax = 8989
-const portMin = 8080
+var mockServer *MockServer
+var jsonAsserter = jsonAssert.Instance()
 
 // HTTPMethod ... type GET, POST, DELETE, PUT, PATCH, HEAD
 type HTTPMethod int
@@ -48,85 +55,517 @@ func (method HTTPMethod) String() string {
 	return httpMethod[method-1]
 }
 
+func parseHTTPMethod(name string) (HTTPMethod, error) {
+	for i, method := range httpMethod {
+		if method == name {
+			return HTTPMethod(i + 1), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown method %q", name)
+}
+
 // MockServer represent the server that will contains all your stubs. When you are developing a microservice architecture you should talk with a lot of third party services, or other decouple service, so in order to test your solution you must mock all of these services. MockServer is the server that will mock those third party services.
 type MockServer struct {
-	stubWhen map[HTTPMethod]*stubReturn
+	stubs    []*stubReturn
 	Port     int
+	host     string
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+	journal  journal
+
+	unmatchedPolicy UnmatchedPolicy
+	scenarios       scenarios
+	defaultDelay    Delay
+	sessions        map[string]*session
+	inSession       bool
+	tlsConfig       *tls.Config
+	caPEM           []byte
+	tlsDefault      bool
+	http2           bool
+	recordings      []*stubReturn
+	playback        bool
+	playbackMode    PlaybackMode
+	watched         []*stubReturn
+	watcher         *stubWatcher
+
+	// mutex protect the stubs, the policies and the server, requests are served while stubs are added or removed.
+	mutex sync.RWMutex
 }
 
 type stubReturn struct {
-	path       *regexp.Regexp
-	thenReturn []byte
-	status     int
-	headers    map[string]string
+	method          HTTPMethod
+	pathExpr        string
+	path            *regexp.Regexp
+	pathTemplate    bool
+	pathOnly        bool
+	headers         []namedMatcher
+	jsonBody        []byte
+	jsonIgnorePaths []string
+	body            Matcher
+	queryParams     []namedMatcher
+	exactQuery      bool
+	responseHeaders http.Header
+	responseCookies []*http.Cookie
+	responses       []*stubResponse
+	exhausted       SequencePolicy
+	calls           int
+	mutex           sync.RWMutex
+	scenario        string
+	requiredState   string
+	newState        string
+	delay           Delay
+	protocol        string
 }
 
+// Responder compute the stub response from the inbound request. The returned headers are added to the stub response headers.
+type Responder func(r *http.Request) (status int, headers http.Header, body []byte)
+
 // StubAction is the interface, the behavior of your mockServer. Don't forget clean your stubs(CleanStub) at the begining of each test.
 type StubAction interface {
 	When(httpMethod HTTPMethod, pathExpr string) StubReturn
 
+	OnUnmatched(policy UnmatchedPolicy)
+	DefaultDelay(delay Delay)
+
+	Verify(httpMethod HTTPMethod, pathExpr string) Verification
+	Requests() []RecordedRequest
+
+	NewSession() Session
+
+	LoadStubs(path string) error
+	WatchStubs(dir string, interval time.Duration) error
+	StopWatching()
+	Playback(dir string, mode PlaybackMode) error
+	StopPlayback()
+
+	ScenarioState(scenario string) string
+	SetScenarioState(scenario string, state string)
+	ResetScenarios()
+
 	CleanStub()
 }
 
+// MockServerBehavior is the StubAction of a MockServer plus its lifecycle. Each MockServer built with New owns its own http mux, so you can run as many of them as third party services you need to mock.
+type MockServerBehavior interface {
+	StubAction
+	http.Handler
+
+	SetHost(host string) error
+	Start() error
+	Close() error
+	Shutdown(ctx context.Context) error
+	URL() string
+	Addr() string
+
+	EnableTLS(hostnames ...string) error
+	EnableTLSFromFiles(certFile string, keyFile string) error
+	CACertPEM() []byte
+	CACertPool() *x509.CertPool
+	Client() *http.Client
+	EnableHTTP2() error
+}
+
 // StubReturn will define the behavior of your "When" action.
 type StubReturn interface {
 	WithHeader(key string, value string) StubReturn
+	WithHeaderMatcher(key string, matcher Matcher) StubReturn
+	WithJSONBody(expected []byte, ignorePaths ...string) StubReturn
+	WithBody(matcher Matcher) StubReturn
+	WithQueryParam(name string, matcher Matcher) StubReturn
+	WithProtocol(protocol string) StubReturn
+	WithResponseHeader(key string, value string) StubReturn
+	WithResponseCookie(cookie *http.Cookie) StubReturn
+	WithDelay(d time.Duration) StubReturn
+	WithRandomDelay(min, max time.Duration) StubReturn
+	WithLogNormalDelay(median, p99 time.Duration) StubReturn
 
-	ThenReturn(thenReturn []byte, status int)
+	ThenReturn(thenReturn []byte, status int) StubReturn
+	ThenReturnTemplate(thenReturn []byte, status int) StubReturn
+	ThenRespond(responder Responder) StubReturn
+	ThenServe(handler http.Handler) StubReturn
+	ThenFault(kind Fault) StubReturn
+	WhenExhausted(policy SequencePolicy) StubReturn
+
+	InScenario(scenario string) StubReturn
+	WhenStateIs(state string) StubReturn
+	WillSetStateTo(state string) StubReturn
 }
 
 // Instance return a singleton MockServer instance, this is why is important to clean your stubs before each test.
+// Instance panics if the MockServer can't bind its port, there is no way to run your tests without it.
 func Instance(port ...int) StubAction {
 	mockServerSingleton.Do(func() {
-		mockServer.stubWhen = make(map[HTTPMethod]*stubReturn)
-		if len(port) > 0 {
-			mockServer.Port = port[0]
-		} else {
-			rand.Seed(time.Now().Unix())
-			mockServer.Port = rand.Intn(portMax-portMin) + portMin
+		mockServer = New(port...).(*MockServer)
+		if err := mockServer.Start(); err != nil {
+			panic(err)
 		}
-		http.HandleFunc("/", mockServer.router)
-		go http.ListenAndServe(":"+strconv.Itoa(mockServer.Port), nil) // set listen port
-		fmt.Println("Mock server up and running, listening over http://localhost:" + strconv.Itoa(mockServer.Port))
 	})
-	return &mockServer
+	return mockServer
+}
+
+// New return a new MockServer, not started yet. Unlike Instance, every call builds an independent server with its own stubs and http mux, so nothing is registered over http.DefaultServeMux.
+// If no port is provided, or the port is 0, an ephemeral port will be choosen by the OS when the MockServer starts.
+func New(port ...int) MockServerBehavior {
+	newMockServer := new(MockServer)
+	if len(port) > 0 {
+		newMockServer.Port = port[0]
+	}
+	newMockServer.unmatchedPolicy = NotFound()
+	newMockServer.mux = http.NewServeMux()
+	newMockServer.mux.HandleFunc("/", newMockServer.router)
+	return newMockServer
+}
+
+// SetHost define the address the MockServer listens on, ex 127.0.0.1, all the interfaces by default. Call it before Start, once started it returns an error.
+// If TLS is enabled with the default hostnames its certificate is generated again, so it is valid for the new host too.
+func (mockServer *MockServer) SetHost(host string) error {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	if mockServer.listener != nil {
+		return errors.New("Mock server can't change its host once started, call it before Start")
+	}
+
+	if mockServer.tlsDefault {
+		certificate, caPEM, err := newCertificate(hostnamesOf(host)...)
+		if err != nil {
+			return err
+		}
+		mockServer.tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		mockServer.caPEM = caPEM
+	}
+	mockServer.host = host
+	return nil
+}
+
+// Start ... bind the MockServer port and begin to serve requests. Once Start returns without error the MockServer is already accepting connections, and Port holds the bound port.
+func (mockServer *MockServer) Start() (err error) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", net.JoinHostPort(mockServer.host, strconv.Itoa(mockServer.Port))); err != nil {
+		return fmt.Errorf("Mock server can't listen over port %d: %s", mockServer.Port, err.Error())
+	}
+
+	mockServer.listener = listener
+	mockServer.Port = listener.Addr().(*net.TCPAddr).Port
+	mockServer.server = &http.Server{Handler: mockServer.mux, Protocols: mockServer.protocols()}
+	if mockServer.tlsConfig != nil {
+		mockServer.server.TLSConfig = mockServer.tlsConfig
+		go mockServer.server.ServeTLS(listener, "", "")
+	} else {
+		go mockServer.server.Serve(listener)
+	}
+	fmt.Println("Mock server up and running, listening over " + mockServer.url())
+
+	return
+}
+
+// Close ... shutdown the MockServer, closing its listener and all the active connections. The watched directory is no longer polled.
+func (mockServer *MockServer) Close() error {
+	return mockServer.stop((*http.Server).Close)
+}
+
+// Shutdown ... stop the MockServer gracefully, closing its listener and waiting for the active requests to finish, or for ctx to be done. The watched directory is no longer polled.
+func (mockServer *MockServer) Shutdown(ctx context.Context) error {
+	return mockServer.stop(func(server *http.Server) error {
+		return server.Shutdown(ctx)
+	})
+}
+
+// stop the watcher and the server. The mutex is released before stopping them, so the requests being served can still read the stubs.
+func (mockServer *MockServer) stop(stopServer func(server *http.Server) error) (err error) {
+	mockServer.mutex.Lock()
+	watcher, server := mockServer.watcher, mockServer.server
+	mockServer.watcher = nil
+	mockServer.server = nil
+	mockServer.listener = nil
+	mockServer.mutex.Unlock()
+
+	watcher.close()
+	if server != nil {
+		err = stopServer(server)
+	}
+
+	return
+}
+
+// URL return the base URL of the MockServer, ex http://localhost:8080 or https://localhost:8443 once TLS is enabled. The host is used instead of localhost when it is set to a specific address, see SetHost.
+func (mockServer *MockServer) URL() string {
+	mockServer.mutex.RLock()
+	defer mockServer.mutex.RUnlock()
+
+	return mockServer.url()
+}
+
+func (mockServer *MockServer) url() string {
+	host := "localhost"
+	if ip := net.ParseIP(mockServer.host); mockServer.host != "" && (ip == nil || !ip.IsUnspecified()) {
+		host = mockServer.host
+	}
+
+	scheme := "http://"
+	if mockServer.tlsConfig != nil {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, strconv.Itoa(mockServer.Port))
+}
+
+// Addr return the address where the MockServer is listening, ex [::]:8080. Empty if the MockServer is not started.
+func (mockServer *MockServer) Addr() (addr string) {
+	mockServer.mutex.RLock()
+	defer mockServer.mutex.RUnlock()
+
+	if mockServer.listener != nil {
+		addr = mockServer.listener.Addr().String()
+	}
+
+	return
+}
+
+// ServeHTTP ... a MockServer is also an http.Handler, so you can mount it in your own server or in an httptest.Server
+func (mockServer *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mockServer.mux.ServeHTTP(w, r)
 }
 
 func (mockServer *MockServer) router(w http.ResponseWriter, r *http.Request) {
+	scope, sessionRequest, unknownID := mockServer.routeSession(r)
+	switch {
+	case scope != nil:
+		scope.router(w, sessionRequest)
+		return
+	case unknownID != "":
+		mockServer.unknownSession(w, r, unknownID)
+		return
+	}
+
 	fullPath := mockServer.fullPath(r)
-	var match bool
-	for method, stub := range mockServer.stubWhen {
-		if r.Method == method.String() {
-			if stub.path.MatchString(fullPath) && mockServer.checkHeaders(r, stub.headers) {
-				w = mockServer.buildResponse(w, stub)
-				match = true
-				break
+	entry := mockServer.journal.record(r, fullPath)
+	stubs, unmatchedPolicy := mockServer.snapshot()
+	var nearMisses []NearMiss
+	for _, stub := range stubs {
+		failures := mockServer.checkStub(r, fullPath, stub)
+		if len(failures) == 0 {
+			response, failure := stub.nextResponse(&mockServer.scenarios)
+			if response != nil {
+				pathParams := stub.pathParams(r.URL.Path)
+				mockServer.journal.matched(entry, stub, pathParams)
+				if mockServer.wait(r, stub) {
+					mockServer.buildResponse(w, withPathParams(r, pathParams), stub, response)
+				}
+				return
 			}
+			failures = append(failures, failure)
+		}
+		nearMisses = append(nearMisses, NearMiss{Stub: stub.String(), Failures: failures})
+	}
+
+	mockServer.journal.mismatched(entry, mismatches(nearMisses))
+	unmatchedPolicy(w, r, newUnmatchedRequest(r, fullPath, nearMisses))
+}
+
+// snapshot return the current stubs and unmatched policy. The stubs slice is never modified in place, so it can be iterated while new stubs are added.
+// The watched stubs go after the stubs added with When. During a playback the recordings go first, and in Strict mode they are the only stubs.
+func (mockServer *MockServer) snapshot() ([]*stubReturn, UnmatchedPolicy) {
+	mockServer.mutex.RLock()
+	defer mockServer.mutex.RUnlock()
+
+	stubs := mockServer.stubs
+	if len(mockServer.watched) > 0 {
+		stubs = append(append([]*stubReturn(nil), mockServer.stubs...), mockServer.watched...)
+	}
+
+	switch {
+	case !mockServer.playback:
+		return stubs, mockServer.unmatchedPolicy
+	case mockServer.playbackMode == Strict:
+		return mockServer.recordings, mockServer.unmatchedPolicy
+	default:
+		return append(append([]*stubReturn(nil), mockServer.recordings...), stubs...), mockServer.unmatchedPolicy
+	}
+}
+
+// wait the stub delay, or the MockServer default delay. It return false if the client cancelled the request meanwhile.
+func (mockServer *MockServer) wait(r *http.Request, stub *stubReturn) bool {
+	stub.mutex.RLock()
+	delay := stub.delay
+	stub.mutex.RUnlock()
+
+	if delay == nil {
+		mockServer.mutex.RLock()
+		delay = mockServer.defaultDelay
+		mockServer.mutex.RUnlock()
+	}
+
+	return wait(r, delay)
+}
+
+// checkStub evaluate all the stub preconditions, and return the ones that fail. The stub match the request if there is no failure.
+func (mockServer *MockServer) checkStub(r *http.Request, fullPath string, stub *stubReturn) (failures []string) {
+	stub.mutex.RLock()
+	defer stub.mutex.RUnlock()
+
+	if r.Method != stub.method.String() {
+		failures = append(failures, fmt.Sprintf("method expected %s but was %s", stub.method, r.Method))
+	}
+	if failure := mockServer.checkPath(r, fullPath, stub); failure != "" {
+		failures = append(failures, failure)
+	}
+	if failure := mockServer.checkProtocol(r, stub); failure != "" {
+		failures = append(failures, failure)
+	}
+	failures = append(failures, mockServer.checkQueryParams(r, stub)...)
+	failures = append(failures, mockServer.checkHeaders(r, stub)...)
+	if failure := mockServer.checkJSONBody(r, stub); failure != "" {
+		failures = append(failures, failure)
+	}
+	if failure := mockServer.checkBody(r, stub); failure != "" {
+		failures = append(failures, failure)
+	}
+	if failure := mockServer.checkScenario(stub); failure != "" {
+		failures = append(failures, failure)
+	}
+
+	return
+}
+
+// checkPath evaluate the stub path regex over the fullPath, or over the path only when the stub is a path template, comes from a stub file or has query param matchers.
+func (mockServer *MockServer) checkPath(r *http.Request, fullPath string, stub *stubReturn) (failure string) {
+	path := fullPath
+	if stub.pathTemplate || stub.pathOnly || len(stub.queryParams) > 0 {
+		path = r.URL.Path
+	}
+
+	if !stub.path.MatchString(path) {
+		failure = fmt.Sprintf("path expected to match %q but was %q", stub.pathExpr, path)
+	}
+
+	return
+}
+
+func (mockServer *MockServer) checkQueryParams(r *http.Request, stub *stubReturn) (failures []string) {
+	query := r.URL.Query()
+	expected := make(map[string]bool, len(stub.queryParams))
+	for _, queryParam := range stub.queryParams {
+		expected[queryParam.name] = true
+		values := query[queryParam.name]
+		if !queryParam.matcher.Match(values) {
+			failures = append(failures, fmt.Sprintf("query param %s expected %s but was %q", queryParam.name, queryParam.matcher, values))
 		}
 	}
 
-	if !match {
-		panic(errors.New("No stub found for path" + fullPath))
+	if stub.exactQuery {
+		var unexpected []string
+		for name := range query {
+			if !expected[name] {
+				unexpected = append(unexpected, name)
+			}
+		}
+		sort.Strings(unexpected)
+		for _, name := range unexpected {
+			failures = append(failures, fmt.Sprintf("query param %s unexpected", name))
+		}
 	}
 
+	return
 }
 
-func (mockServer *MockServer) checkHeaders(r *http.Request, headers map[string]string) (match bool) {
-	match = true
-	if len(headers) > 0 {
-		for expectedKey, expectedHeader := range headers {
-			match = r.Header.Get(expectedKey) == expectedHeader
+// checkHeaders return why the request headers don't match the stub header preconditions. All of them must match.
+func (mockServer *MockServer) checkHeaders(r *http.Request, stub *stubReturn) (failures []string) {
+	for _, header := range stub.headers {
+		values := r.Header[http.CanonicalHeaderKey(header.name)]
+		if !header.matcher.Match(values) {
+			failures = append(failures, fmt.Sprintf("header %s expected %s but was %q", header.name, header.matcher, values))
 		}
 	}
 
 	return
 }
 
-func (mockServer *MockServer) buildResponse(w http.ResponseWriter, stub *stubReturn) http.ResponseWriter {
-	w.WriteHeader(stub.status)
-	fmt.Fprintf(w, string(stub.thenReturn))
+// checkJSONBody use jsonAssert in order to compare the request body with the expected one, so the stubs and your asserts agree on what JSON equals means.
+func (mockServer *MockServer) checkJSONBody(r *http.Request, stub *stubReturn) (failure string) {
+	if stub.jsonBody == nil {
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := jsonAsserter.AssertJsonEquals(stub.jsonBody, body, stub.jsonIgnorePaths...); err != nil {
+		failure = "body " + err.Error()
+	}
 
-	return w
+	return
+}
+
+func (mockServer *MockServer) checkBody(r *http.Request, stub *stubReturn) (failure string) {
+	if stub.body == nil {
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !stub.body.Match([]string{string(body)}) {
+		failure = fmt.Sprintf("body expected %s but was %q", stub.body, body)
+	}
+
+	return
+}
+
+func (mockServer *MockServer) buildResponse(w http.ResponseWriter, r *http.Request, stub *stubReturn, response *stubResponse) {
+	if response.fault != 0 {
+		serveFault(w, response.fault)
+		return
+	}
+
+	stub.mutex.RLock()
+	if !response.templated {
+		addHeaders(w.Header(), stub.responseHeaders)
+	}
+	for _, cookie := range stub.responseCookies {
+		http.SetCookie(w, cookie)
+	}
+	stub.mutex.RUnlock()
+	addHeaders(w.Header(), response.headers)
+
+	if response.handler != nil {
+		response.handler.ServeHTTP(w, r)
+		return
+	}
+
+	status, body := response.status, response.thenReturn
+	if response.responder != nil {
+		var headers http.Header
+		status, headers, body = response.responder(r)
+		addHeaders(w.Header(), headers)
+	}
+
+	if w.Header().Get("Content-Type") == "" && len(body) > 0 {
+		w.Header().Set("Content-Type", contentType(body))
+	}
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func addHeaders(dst http.Header, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// contentType detects the Content-Type of a response body. http.DetectContentType doesn't know about JSON, so a valid JSON body is application/json.
+func contentType(body []byte) string {
+	if json.Valid(body) {
+		return "application/json"
+	}
+
+	return http.DetectContentType(body)
 }
 
 func (mockServer *MockServer) fullPath(r *http.Request) (fullPath string) {
@@ -139,28 +578,105 @@ func (mockServer *MockServer) fullPath(r *http.Request) (fullPath string) {
 	return
 }
 
-// When ... define the precondition that should be achived in order to trigger the stubReturn. pathExpr must be a URL regular expression.
+// When ... define the precondition that should be achived in order to trigger the stubReturn. pathExpr must be a URL regular expression, or a path template as /users/{login}/repos/{id:int}.
+// A path template is anchored and matches the path only, its captures can be typed with int, uuid, path or string (default) and are available through PathParams.
+// You can register as many stubs as you want for the same HTTPMethod, they are evaluated from the most recent to the oldest one, so the last matching stub wins.
 func (mockServer *MockServer) When(httpMethod HTTPMethod, pathExpr string) StubReturn {
-	stubReturn := new(stubReturn)
-	stubReturn.path = regexp.MustCompile(pathExpr)
-	stubReturn.headers = make(map[string]string)
-	mockServer.stubWhen[httpMethod] = stubReturn
-	return stubReturn
+	stub := newStubReturn(httpMethod, pathExpr)
+
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.stubs = append([]*stubReturn{stub}, mockServer.stubs...)
+	return stub
 }
 
-// CleanStub ... cleans all stub defined previously
+func newStubReturn(httpMethod HTTPMethod, pathExpr string) *stubReturn {
+	stub := new(stubReturn)
+	stub.method = httpMethod
+	stub.pathExpr = pathExpr
+	stub.path, stub.pathTemplate = compilePathExpr(pathExpr)
+	stub.responseHeaders = make(http.Header)
+	return stub
+}
+
+// CleanStub ... cleans all stub defined previously, the requests received so far and the scenarios state. A playback and the watched stubs are kept, see StopPlayback and StopWatching.
 func (mockServer *MockServer) CleanStub() {
-	mockServer.stubWhen = make(map[HTTPMethod]*stubReturn)
+	mockServer.mutex.Lock()
+	mockServer.stubs = nil
+	mockServer.mutex.Unlock()
+	mockServer.journal.clean()
+	mockServer.scenarios.reset()
 }
 
-// ThenReturn, is the action that will be returned for a given precondition.
-func (mockServer *stubReturn) ThenReturn(thenReturn []byte, status int) {
-	mockServer.thenReturn = thenReturn
-	mockServer.status = status
+func (stub *stubReturn) String() string {
+	return stub.method.String() + " " + stub.pathExpr
 }
 
-// WithHeader is used in order to add a header precondition that should be achived in order to trigger the stubReturn.
+// ThenReturn, is the action that will be returned for a given precondition. Chain several Then actions in order to return a sequence of responses, one per call, ex ThenReturn(nil, 503).ThenReturn(body, 200). See WhenExhausted.
+func (mockServer *stubReturn) ThenReturn(thenReturn []byte, status int) StubReturn {
+	return mockServer.thenResponse(&stubResponse{thenReturn: thenReturn, status: status})
+}
+
+// WithJSONBody is used in order to add a request body precondition. The request body must be a JSON equals to expected, ignoring the optional ignorePaths, ex /Time. See jsonAssert.AssertJsonEquals
+func (mockServer *stubReturn) WithJSONBody(expected []byte, ignorePaths ...string) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.jsonBody = expected
+	mockServer.jsonIgnorePaths = ignorePaths
+	return mockServer
+}
+
+// WithBody is used in order to add a raw request body precondition, ex WithBody(Contains("grant_type=client_credentials")) for a form body.
+func (mockServer *stubReturn) WithBody(matcher Matcher) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.body = matcher
+	return mockServer
+}
+
+// ThenRespond is the action that will compute the response for a given precondition, ex echo an ID from the request.
+func (mockServer *stubReturn) ThenRespond(responder Responder) StubReturn {
+	return mockServer.thenResponse(&stubResponse{responder: responder})
+}
+
+// ThenServe delegate the response for a given precondition to handler. The stub response headers and cookies are added before calling it.
+func (mockServer *stubReturn) ThenServe(handler http.Handler) StubReturn {
+	return mockServer.thenResponse(&stubResponse{handler: handler})
+}
+
+// WithQueryParam is used in order to add a query param precondition, ex WithQueryParam("page", EqualTo("2")). Query params are parsed, so their order doesn't matter, and once a stub has a query param precondition its pathExpr is evaluated over the path only.
+func (mockServer *stubReturn) WithQueryParam(name string, matcher Matcher) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.queryParams = append(mockServer.queryParams, namedMatcher{name: name, matcher: matcher})
+	return mockServer
+}
+
+// WithResponseHeader add a header to the stub response, ex WithResponseHeader("Location", "/v1/users/1"). If no Content-Type is defined it will be detected from the body.
+func (mockServer *stubReturn) WithResponseHeader(key string, value string) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.responseHeaders.Add(key, value)
+	return mockServer
+}
+
+// WithResponseCookie add a Set-Cookie header to the stub response.
+func (mockServer *stubReturn) WithResponseCookie(cookie *http.Cookie) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.responseCookies = append(mockServer.responseCookies, cookie)
+	return mockServer
+}
+
+// WithHeader is used in order to add a header precondition that should be achived in order to trigger the stubReturn. All the header preconditions must be achived.
 func (mockServer *stubReturn) WithHeader(key string, value string) StubReturn {
-	mockServer.headers[key] = value
+	return mockServer.WithHeaderMatcher(key, EqualTo(value))
+}
+
+// WithHeaderMatcher is used in order to add a header precondition with any Matcher, ex WithHeaderMatcher("Accept", Contains("json")).
+func (mockServer *stubReturn) WithHeaderMatcher(key string, matcher Matcher) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.headers = append(mockServer.headers, namedMatcher{name: key, matcher: matcher})
 	return mockServer
 }
@@ -2,9 +2,23 @@ package mockServer
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pjgg/rest-in-peace/jsonAssert"
 	"github.com/stretchr/testify/assert"
@@ -71,16 +85,162 @@ func (testSuit *mockServerSuite) TestHelloWorldWithHeadersError() {
 	req, _ := newHTTPRequest("GET", "http://localhost:8080/v1/service/hello/", nil, nil)
 	req.Header.Add("Content-Type", "application/text")
 	if resp, err = makeHTTPQuery(req); err == nil {
-		data, _ := ioutil.ReadAll(resp.Body)
+		var unmatched UnmatchedRequest
+		json.NewDecoder(resp.Body).Decode(&unmatched)
 
-		assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals(outboundJSON, data), "Unexpected error")
-		assert.Equal(testSuit.T(), 200, resp.StatusCode)
+		assert.Equal(testSuit.T(), 404, resp.StatusCode)
+		assert.Equal(testSuit.T(), "No stub found for GET /v1/service/hello/", unmatched.Error)
+		if assert.Len(testSuit.T(), unmatched.NearMisses, 1) {
+			assert.Equal(testSuit.T(), "GET /v1/service/hello*", unmatched.NearMisses[0].Stub)
+			assert.Equal(testSuit.T(), []string{`header Content-Type expected equal to "application/json" but was ["application/text"]`}, unmatched.NearMisses[0].Failures)
+		}
 	}
 
 	if err != nil {
-		assert.Error(testSuit.T(), err)
+		testSuit.Fail("Unexpected error", err.Error())
+	}
+
+}
+
+func (testSuit *mockServerSuite) TestHeaderMatchers() {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+
+	headers := func() http.Header {
+		return http.Header{
+			"Content-Type":    {"application/json"},
+			"Authorization":   {"Bearer abc123"},
+			"Accept":          {"text/plain, application/json"},
+			"X-Env":           {"test"},
+			"Accept-Language": {"en-GB", "en-US"},
+		}
+	}
+	mismatches := map[string]func(header http.Header){
+		"":              func(header http.Header) {},
+		"Content-Type":  func(header http.Header) { header.Set("Content-Type", "application/text") },
+		"Authorization": func(header http.Header) { header.Set("Authorization", "Basic abc123") },
+		"Accept":        func(header http.Header) { header.Set("Accept", "text/plain") },
+		"X-Debug":       func(header http.Header) { header.Set("X-Debug", "true") },
+		"X-Env":         func(header http.Header) { header.Set("X-Env", "prod") },
+		"Accept-Language": func(header http.Header) {
+			header.Add("Accept-Language", "es-ES")
+		},
+	}
+	for failedHeader, mismatch := range mismatches {
+		testSuit.mockServer.CleanStub()
+		testSuit.mockServer.When(GET, "/v1/service/hello*").
+			WithHeader("Content-Type", "application/json").
+			WithHeaderMatcher("Authorization", Matches("^Bearer \\w+$")).
+			WithHeaderMatcher("Accept", Contains("json")).
+			WithHeaderMatcher("X-Debug", Absent()).
+			WithHeaderMatcher("X-Env", EqualToIgnoreCase("TEST")).
+			WithHeaderMatcher("Accept-Language", Every(Matches("^en"))).
+			ThenReturn(outboundJSON, 200)
+
+		req, _ := newHTTPRequest("GET", "http://localhost:8080/v1/service/hello/", nil, nil)
+		req.Header = headers()
+		mismatch(req.Header)
+		resp, err := makeHTTPQuery(req)
+		if !assert.Nil(testSuit.T(), err) {
+			continue
+		}
+		if failedHeader == "" {
+			assert.Equal(testSuit.T(), 200, resp.StatusCode)
+			continue
+		}
+
+		assert.Equal(testSuit.T(), 404, resp.StatusCode, failedHeader)
+		requests := testSuit.mockServer.Requests()
+		if assert.NotEmpty(testSuit.T(), requests) {
+			lastRequest := requests[len(requests)-1]
+			if assert.Len(testSuit.T(), lastRequest.Mismatches, 1) {
+				assert.Contains(testSuit.T(), lastRequest.Mismatches[0], "header "+failedHeader+" expected")
+			}
+		}
+	}
+}
+
+func (testSuit *mockServerSuite) TestResponseHeadersAndCookies() {
+	outboundJSON := []byte(`{"id":"1","name":"Alice"}`)
+
+	testSuit.mockServer.When(POST, "/v1/users").
+		WithResponseHeader("Location", "/v1/users/1").
+		WithResponseHeader("ETag", `"33a64df5"`).
+		WithResponseCookie(&http.Cookie{Name: "session", Value: "abc123", Path: "/"}).
+		ThenReturn(outboundJSON, 201)
+	testSuit.mockServer.When(GET, "/v1/users/1").
+		WithResponseHeader("Content-Type", "application/vnd.users+json").
+		ThenReturn(outboundJSON, 200)
+	testSuit.mockServer.When(GET, "/v1/status").
+		WithResponseHeader("Retry-After", "120").
+		ThenReturn([]byte("<html><body>busy</body></html>"), 503)
+
+	req, _ := newHTTPRequest("POST", "http://localhost:8080/v1/users", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), 201, resp.StatusCode)
+		assert.Equal(testSuit.T(), "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(testSuit.T(), "/v1/users/1", resp.Header.Get("Location"))
+		assert.Equal(testSuit.T(), `"33a64df5"`, resp.Header.Get("ETag"))
+		if assert.Len(testSuit.T(), resp.Cookies(), 1) {
+			assert.Equal(testSuit.T(), "session", resp.Cookies()[0].Name)
+			assert.Equal(testSuit.T(), "abc123", resp.Cookies()[0].Value)
+		}
+	}
+
+	req, _ = newHTTPRequest("GET", "http://localhost:8080/v1/users/1", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), "application/vnd.users+json", resp.Header.Get("Content-Type"))
+	}
+
+	req, _ = newHTTPRequest("GET", "http://localhost:8080/v1/status", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), 503, resp.StatusCode)
+		assert.Equal(testSuit.T(), "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(testSuit.T(), "120", resp.Header.Get("Retry-After"))
+	}
+}
+
+func (testSuit *mockServerSuite) TestProgrammableResponses() {
+	testSuit.mockServer.When(POST, "/v1/users").
+		WithResponseHeader("X-Mock", "rest-in-peace").
+		ThenRespond(func(r *http.Request) (int, http.Header, []byte) {
+			var user map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&user); err != nil || user["name"] == nil {
+				return 400, nil, []byte(`{"error":"name is mandatory"}`)
+			}
+			return 201, http.Header{"Location": {"/v1/users/" + user["name"].(string)}}, []byte(`{"id":"` + user["name"].(string) + `"}`)
+		})
+	testSuit.mockServer.When(GET, "/v1/users/.*").
+		WithResponseHeader("X-Mock", "rest-in-peace").
+		ThenServe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+			w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+		}))
+
+	req, _ := newHTTPRequest("POST", "http://localhost:8080/v1/users", []byte(`{"name":"alice"}`), nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(testSuit.T(), 201, resp.StatusCode)
+		assert.Equal(testSuit.T(), "/v1/users/alice", resp.Header.Get("Location"))
+		assert.Equal(testSuit.T(), "rest-in-peace", resp.Header.Get("X-Mock"))
+		assert.Equal(testSuit.T(), "application/json", resp.Header.Get("Content-Type"))
+		assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals([]byte(`{"id":"alice"}`), data))
+	}
+
+	req, _ = newHTTPRequest("POST", "http://localhost:8080/v1/users", []byte(`{}`), nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), 400, resp.StatusCode)
+	}
+
+	req, _ = newHTTPRequest("GET", "http://localhost:8080/v1/users/alice", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(testSuit.T(), 200, resp.StatusCode)
+		assert.Equal(testSuit.T(), "rest-in-peace", resp.Header.Get("X-Mock"))
+		assert.Equal(testSuit.T(), `{"path":"/v1/users/alice"}`, string(data))
 	}
 
+	assert.Nil(testSuit.T(), testSuit.mockServer.Verify(POST, "/v1/users").Times(2))
+	assert.Equal(testSuit.T(), "GET /v1/users/.*", testSuit.mockServer.Requests()[2].MatchedStub)
 }
 
 func (testSuit *mockServerSuite) TestComplexResponse() {
@@ -125,6 +285,1282 @@ func (testSuit *mockServerSuite) TestRequestWithMultipleQueryParams() {
 
 }
 
+func (testSuit *mockServerSuite) TestRequestWithQueryParamMatchers() {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+
+	testSuit.mockServer.When(GET, "^/v1/service/hello$").
+		WithQueryParam("param", Matches("^\\d+$")).
+		WithQueryParam("param_two", EqualTo("11")).
+		WithQueryParam("tag", Values("b", "a")).
+		WithQueryParam("debug", Present()).
+		WithQueryParam("trace", Absent()).
+		ThenReturn(outboundJSON, 200)
+
+	queries := map[string]int{
+		"param=10&param_two=11&tag=a&tag=b&debug":       200,
+		"debug=&tag=b&param_two=11&tag=a&param=10":      200,
+		"param=10&param_two=11&tag=a&tag=b&debug&trace": 404,
+		"param=ten&param_two=11&tag=a&tag=b&debug":      404,
+		"param=10&param_two=12&tag=a&tag=b&debug":       404,
+		"param=10&param_two=11&tag=a&debug":             404,
+		"param=10&param_two=11&tag=a&tag=b":             404,
+	}
+	for query, status := range queries {
+		req, _ := newHTTPRequest("GET", "http://localhost:8080/v1/service/hello?"+query, nil, nil)
+		resp, err := makeHTTPQuery(req)
+		if assert.Nil(testSuit.T(), err, query) {
+			assert.Equal(testSuit.T(), status, resp.StatusCode, query)
+		}
+	}
+}
+
+func (testSuit *mockServerSuite) TestPathTemplates() {
+	testSuit.mockServer.When(GET, "/users/{login}/repos/{id:int}").ThenRespond(func(r *http.Request) (int, http.Header, []byte) {
+		params := PathParams(r)
+		return 200, nil, []byte(`{"login":"` + params["login"] + `","id":` + params["id"] + `}`)
+	})
+
+	paths := map[string]int{
+		"/users/pjgg/repos/42":         200,
+		"/users/pjgg/repos/42?page=2":  200,
+		"/users/pjgg/repos/rest":       404,
+		"/users/pjgg/repos/42/commits": 404,
+		"/v1/users/pjgg/repos/42":      404,
+	}
+	for path, status := range paths {
+		req, _ := newHTTPRequest("GET", "http://localhost:8080"+path, nil, nil)
+		if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+			data, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(testSuit.T(), status, resp.StatusCode, path)
+			if status == 200 {
+				assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals([]byte(`{"login":"pjgg","id":42}`), data))
+			}
+		}
+	}
+
+	for _, recordedRequest := range testSuit.mockServer.Requests() {
+		if recordedRequest.MatchedStub != "" {
+			assert.Equal(testSuit.T(), "GET /users/{login}/repos/{id:int}", recordedRequest.MatchedStub)
+			assert.Equal(testSuit.T(), map[string]string{"login": "pjgg", "id": "42"}, recordedRequest.PathParams)
+		}
+	}
+	assert.Nil(testSuit.T(), testSuit.mockServer.Verify(GET, "/users/{login}/repos/{id:int}").Times(2))
+
+	assert.Panics(testSuit.T(), func() { testSuit.mockServer.When(GET, "/users/{login:float}") })
+}
+
+func (testSuit *mockServerSuite) TestResponseTemplates() {
+	testSuit.mockServer.When(POST, "/users/{login}").
+		WithResponseHeader("Location", "/users/{{.PathParams.login}}").
+		WithResponseHeader("X-Request-Id", `{{.Header.Get "X-Request-Id"}}`).
+		ThenReturnTemplate([]byte(`{"login":"{{.PathParams.login}}","page":"{{.Query.Get "page"}}","name":"{{.JSON.user.name}}","token":"{{base64 .PathParams.login}}","id":"{{uuid}}","n":{{randomInt 1 10}},"date":"{{now "2006"}}"}`), 201)
+
+	req, _ := newHTTPRequest("POST", "http://localhost:8080/users/pjgg?page=2", []byte(`{"user":{"name":"Pablo"}}`), nil)
+	req.Header.Add("X-Request-Id", "42")
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		var user map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&user)
+		assert.Equal(testSuit.T(), 201, resp.StatusCode)
+		assert.Equal(testSuit.T(), "/users/pjgg", resp.Header.Get("Location"))
+		assert.Equal(testSuit.T(), "42", resp.Header.Get("X-Request-Id"))
+		assert.Equal(testSuit.T(), "pjgg", user["login"])
+		assert.Equal(testSuit.T(), "2", user["page"])
+		assert.Equal(testSuit.T(), "Pablo", user["name"])
+		assert.Equal(testSuit.T(), "cGpnZw==", user["token"])
+		assert.Regexp(testSuit.T(), "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", user["id"])
+		assert.True(testSuit.T(), user["n"].(float64) >= 1 && user["n"].(float64) < 10)
+		assert.Equal(testSuit.T(), strconv.Itoa(time.Now().Year()), user["date"])
+	}
+
+	testSuit.mockServer.When(GET, "/broken").ThenReturnTemplate([]byte(`{{.Unknown}}`), 200)
+	req, _ = newHTTPRequest("GET", "http://localhost:8080/broken", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), 500, resp.StatusCode)
+	}
+
+	assert.Panics(testSuit.T(), func() { testSuit.mockServer.When(GET, "/users").ThenReturnTemplate([]byte(`{{.Path`), 200) })
+}
+
+func (testSuit *mockServerSuite) TestSequentialResponses() {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+	statuses := func(path string, calls int) (statuses []int) {
+		for i := 0; i < calls; i++ {
+			req, _ := newHTTPRequest("GET", "http://localhost:8080"+path, nil, nil)
+			if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+				statuses = append(statuses, resp.StatusCode)
+			}
+		}
+		return
+	}
+
+	testSuit.mockServer.When(GET, "/retry").ThenReturn(nil, 503).ThenReturn(nil, 503).ThenReturn(outboundJSON, 200)
+	assert.Equal(testSuit.T(), []int{503, 503, 200, 200}, statuses("/retry", 4))
+
+	testSuit.mockServer.When(GET, "/cycle").ThenReturn(nil, 503).ThenReturn(outboundJSON, 200).WhenExhausted(Cycle)
+	assert.Equal(testSuit.T(), []int{503, 200, 503, 200}, statuses("/cycle", 4))
+
+	testSuit.mockServer.When(GET, "/fallthrough").ThenReturn(outboundJSON, 200)
+	testSuit.mockServer.When(GET, "/fallthrough").ThenReturn(nil, 429).ThenReturn(nil, 429).WhenExhausted(FallThrough)
+	assert.Equal(testSuit.T(), []int{429, 429, 200, 200}, statuses("/fallthrough", 4))
+}
+
+func (testSuit *mockServerSuite) TestConcurrentSequentialResponses() {
+	const calls = 50
+	stub := testSuit.mockServer.When(GET, "/concurrent")
+	for i := 0; i < calls; i++ {
+		stub.ThenReturn(nil, 200+i)
+	}
+	stub.WhenExhausted(FallThrough)
+
+	var wg sync.WaitGroup
+	received := make(chan int, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := newHTTPRequest("GET", "http://localhost:8080/concurrent", nil, nil)
+			if resp, err := makeHTTPQuery(req); err == nil {
+				received <- resp.StatusCode
+			}
+		}()
+	}
+	wg.Wait()
+	close(received)
+
+	served := make(map[int]bool)
+	for status := range received {
+		assert.False(testSuit.T(), served[status], "status %d served twice", status)
+		served[status] = true
+	}
+	assert.Len(testSuit.T(), served, calls)
+}
+
+func (testSuit *mockServerSuite) TestScenarios() {
+	order := func() string {
+		req, _ := newHTTPRequest("GET", "http://localhost:8080/orders/1", nil, nil)
+		resp, err := makeHTTPQuery(req)
+		if !assert.Nil(testSuit.T(), err) {
+			return ""
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		return string(data)
+	}
+	post := func(path string) int {
+		req, _ := newHTTPRequest("POST", "http://localhost:8080"+path, nil, nil)
+		resp, err := makeHTTPQuery(req)
+		if !assert.Nil(testSuit.T(), err) {
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	testSuit.mockServer.When(POST, "^/orders$").InScenario("order").WhenStateIs(ScenarioStarted).WillSetStateTo("Created").ThenReturn([]byte(`{"id":1}`), 201)
+	testSuit.mockServer.When(POST, "^/orders/1/payment$").InScenario("order").WhenStateIs("Created").WillSetStateTo("Paid").ThenReturn(nil, 204)
+	testSuit.mockServer.When(GET, "^/orders/1$").InScenario("order").WhenStateIs("Created").ThenReturn([]byte(`{"status":"created"}`), 200)
+	testSuit.mockServer.When(GET, "^/orders/1$").InScenario("order").WhenStateIs("Paid").ThenReturn([]byte(`{"status":"paid"}`), 200)
+
+	assert.Equal(testSuit.T(), ScenarioStarted, testSuit.mockServer.ScenarioState("order"))
+	assert.Equal(testSuit.T(), 404, post("/orders/1/payment"))
+	assert.Equal(testSuit.T(), 201, post("/orders"))
+	assert.Equal(testSuit.T(), "Created", testSuit.mockServer.ScenarioState("order"))
+	assert.Equal(testSuit.T(), `{"status":"created"}`, order())
+	assert.Equal(testSuit.T(), 204, post("/orders/1/payment"))
+	assert.Equal(testSuit.T(), `{"status":"paid"}`, order())
+	assert.Equal(testSuit.T(), 404, post("/orders"))
+	assert.Contains(testSuit.T(), testSuit.mockServer.Requests()[5].Mismatches[0], "scenario order expected state Started but was Paid")
+
+	testSuit.mockServer.SetScenarioState("order", "Created")
+	assert.Equal(testSuit.T(), `{"status":"created"}`, order())
+	testSuit.mockServer.ResetScenarios()
+	assert.Equal(testSuit.T(), ScenarioStarted, testSuit.mockServer.ScenarioState("order"))
+}
+
+func (testSuit *mockServerSuite) TestScenarioFallThrough() {
+	status := func() int {
+		req, _ := newHTTPRequest("GET", "http://localhost:8080/jobs/1", nil, nil)
+		resp, err := makeHTTPQuery(req)
+		if !assert.Nil(testSuit.T(), err) {
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	testSuit.mockServer.When(GET, "^/jobs/1$").ThenReturn(nil, 204)
+	testSuit.mockServer.When(GET, "^/jobs/1$").InScenario("job").WhenStateIs(ScenarioStarted).WillSetStateTo("Moved").
+		ThenReturn(nil, 202).WhenExhausted(FallThrough)
+
+	assert.Equal(testSuit.T(), 202, status())
+	assert.Equal(testSuit.T(), "Moved", testSuit.mockServer.ScenarioState("job"))
+
+	testSuit.mockServer.SetScenarioState("job", ScenarioStarted)
+	assert.Equal(testSuit.T(), 204, status())
+	assert.Equal(testSuit.T(), ScenarioStarted, testSuit.mockServer.ScenarioState("job"), "an exhausted stub that falls through must not move its scenario")
+}
+
+func (testSuit *mockServerSuite) TestDelays() {
+	defer testSuit.mockServer.DefaultDelay(nil)
+	elapsed := func(path string, timeout time.Duration) (time.Duration, error) {
+		client := &http.Client{Timeout: timeout}
+		start := time.Now()
+		resp, err := client.Get("http://localhost:8080" + path)
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		return time.Since(start), err
+	}
+
+	testSuit.mockServer.When(GET, "/fixed").WithDelay(100*time.Millisecond).ThenReturn(nil, 200)
+	testSuit.mockServer.When(GET, "/random").WithRandomDelay(50*time.Millisecond, 80*time.Millisecond).ThenReturn(nil, 200)
+	testSuit.mockServer.When(GET, "/lognormal").WithLogNormalDelay(30*time.Millisecond, 30*time.Millisecond).ThenReturn(nil, 200)
+	testSuit.mockServer.When(GET, "/default").ThenReturn(nil, 200)
+	testSuit.mockServer.When(GET, "/slow").WithDelay(time.Minute).ThenReturn(nil, 200)
+
+	if d, err := elapsed("/fixed", time.Second); assert.Nil(testSuit.T(), err) {
+		assert.True(testSuit.T(), d >= 100*time.Millisecond, "fixed delay was %s", d)
+	}
+	if d, err := elapsed("/random", time.Second); assert.Nil(testSuit.T(), err) {
+		assert.True(testSuit.T(), d >= 50*time.Millisecond, "random delay was %s", d)
+	}
+	if d, err := elapsed("/lognormal", time.Second); assert.Nil(testSuit.T(), err) {
+		assert.True(testSuit.T(), d >= 30*time.Millisecond, "log-normal delay was %s", d)
+	}
+
+	testSuit.mockServer.DefaultDelay(FixedDelay(60 * time.Millisecond))
+	if d, err := elapsed("/default", time.Second); assert.Nil(testSuit.T(), err) {
+		assert.True(testSuit.T(), d >= 60*time.Millisecond, "default delay was %s", d)
+	}
+	if d, err := elapsed("/fixed", time.Second); assert.Nil(testSuit.T(), err) {
+		assert.True(testSuit.T(), d >= 100*time.Millisecond, "stub delay must win over the default, was %s", d)
+	}
+
+	_, err := elapsed("/slow", 50*time.Millisecond)
+	assert.Error(testSuit.T(), err)
+}
+
+func TestLogNormalDelay(t *testing.T) {
+	delay := LogNormalDelay(20*time.Millisecond, 200*time.Millisecond)
+	var belowMedian, belowP99 int
+	const samples = 10000
+	for i := 0; i < samples; i++ {
+		d := delay()
+		if d <= 20*time.Millisecond {
+			belowMedian++
+		}
+		if d <= 200*time.Millisecond {
+			belowP99++
+		}
+	}
+
+	assert.InDelta(t, 0.5, float64(belowMedian)/samples, 0.03)
+	assert.InDelta(t, 0.99, float64(belowP99)/samples, 0.01)
+}
+
+func (testSuit *mockServerSuite) TestFaults() {
+	expectedErrors := map[Fault]string{
+		ConnectionReset:     "connection reset by peer",
+		EmptyResponse:       "EOF",
+		ClosedBeforeHeaders: "EOF",
+		MalformedResponse:   "malformed HTTP",
+	}
+	for kind, expectedError := range expectedErrors {
+		testSuit.mockServer.CleanStub()
+		testSuit.mockServer.When(POST, "/fault").ThenFault(kind)
+
+		req, _ := newHTTPRequest("POST", "http://localhost:8080/fault", nil, nil)
+		_, err := makeHTTPQuery(req)
+		if assert.Error(testSuit.T(), err, kind.String()) {
+			assert.Contains(testSuit.T(), err.Error(), expectedError, kind.String())
+		}
+		assert.Nil(testSuit.T(), testSuit.mockServer.Verify(POST, "/fault").Times(1), kind.String())
+	}
+
+	testSuit.mockServer.When(POST, "/truncated").ThenFault(TruncatedBody).ThenReturn(nil, 200)
+	req, _ := newHTTPRequest("POST", "http://localhost:8080/truncated", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), int64(1024), resp.ContentLength)
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.Equal(testSuit.T(), io.ErrUnexpectedEOF, err)
+	}
+	req, _ = newHTTPRequest("POST", "http://localhost:8080/truncated", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), 200, resp.StatusCode)
+	}
+
+	tlsServer := New()
+	if err := tlsServer.EnableTLS(); err != nil {
+		testSuit.T().Fatal(err)
+	}
+	if err := tlsServer.Start(); err != nil {
+		testSuit.T().Fatal(err)
+	}
+	defer tlsServer.Close()
+	tlsServer.When(POST, "/fault").ThenFault(ConnectionReset)
+	_, err := tlsServer.Client().Post(tlsServer.URL()+"/fault", "application/json", nil)
+	if assert.Error(testSuit.T(), err, "ConnectionReset over TLS") {
+		assert.Contains(testSuit.T(), err.Error(), "connection reset by peer", "ConnectionReset over TLS")
+	}
+}
+
+func (testSuit *mockServerSuite) TestUnmatchedNearMisses() {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+
+	testSuit.mockServer.When(DELETE, "/v1/other").ThenReturn(outboundJSON, 200)
+	testSuit.mockServer.When(POST, "/v1/users").WithJSONBody([]byte(`{"name":"Alice"}`)).ThenReturn(outboundJSON, 201)
+	testSuit.mockServer.When(POST, "/v1/users").WithHeader("X-Tenant", "acme").WithJSONBody([]byte(`{"name":"Bob"}`)).ThenReturn(outboundJSON, 201)
+	testSuit.mockServer.When(GET, "/v1/users").ThenReturn(outboundJSON, 200)
+
+	req, _ := newHTTPRequest("POST", "http://localhost:8080/v1/users", []byte(`{"name":"Bob"}`), nil)
+	resp, err := makeHTTPQuery(req)
+	if !assert.Nil(testSuit.T(), err) {
+		return
+	}
+
+	var unmatched UnmatchedRequest
+	json.NewDecoder(resp.Body).Decode(&unmatched)
+	assert.Equal(testSuit.T(), 404, resp.StatusCode)
+	assert.Equal(testSuit.T(), "application/json", resp.Header.Get("Content-Type"))
+	if assert.Len(testSuit.T(), unmatched.NearMisses, 3) {
+		assert.Equal(testSuit.T(), "POST /v1/users", unmatched.NearMisses[0].Stub)
+		assert.Contains(testSuit.T(), unmatched.NearMisses[0].Failures[0], "header X-Tenant expected")
+		assert.Equal(testSuit.T(), "POST /v1/users", unmatched.NearMisses[1].Stub)
+		assert.Contains(testSuit.T(), unmatched.NearMisses[1].Failures[0], "body Json not equal")
+		assert.Equal(testSuit.T(), "GET /v1/users", unmatched.NearMisses[2].Stub)
+		assert.Contains(testSuit.T(), unmatched.NearMisses[2].Failures[0], "method expected GET but was POST")
+	}
+	assert.Len(testSuit.T(), testSuit.mockServer.Requests()[0].Mismatches, 2)
+}
+
+func (testSuit *mockServerSuite) TestUnmatchedPolicies() {
+	defer testSuit.mockServer.OnUnmatched(NotFound())
+
+	testSuit.mockServer.OnUnmatched(DefaultResponse([]byte(`{"error":"teapot"}`), 418))
+	req, _ := newHTTPRequest("GET", "http://localhost:8080/v1/unknown", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(testSuit.T(), 418, resp.StatusCode)
+		assert.Equal(testSuit.T(), `{"error":"teapot"}`, string(data))
+	}
+
+	reporter := new(testReporter)
+	testSuit.mockServer.OnUnmatched(FailTest(reporter))
+	req, _ = newHTTPRequest("GET", "http://localhost:8080/v1/unknown", nil, nil)
+	if resp, err := makeHTTPQuery(req); assert.Nil(testSuit.T(), err) {
+		assert.Equal(testSuit.T(), 404, resp.StatusCode)
+		if assert.Len(testSuit.T(), reporter.errors, 1) {
+			assert.Equal(testSuit.T(), "No stub found for GET /v1/unknown\n\tthere are no stubs defined", reporter.errors[0])
+		}
+	}
+}
+
+func (testSuit *mockServerSuite) TestManyStubsSameMethod() {
+	var err error
+	var resp *http.Response
+	helloJSON := []byte(`{"key":"hello","value":"world"}`)
+	byeJSON := []byte(`{"key":"bye","value":"world"}`)
+
+	testSuit.mockServer.When(GET, "/v1/service/hello*").ThenReturn(helloJSON, 200)
+	testSuit.mockServer.When(GET, "/v1/service/bye*").ThenReturn(byeJSON, 200)
+
+	req, _ := newHTTPRequest("GET", "http://localhost:8080/v1/service/hello/", nil, nil)
+	if resp, err = makeHTTPQuery(req); err == nil {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals(helloJSON, data), "Unexpected error")
+	}
+
+	req, _ = newHTTPRequest("GET", "http://localhost:8080/v1/service/bye/", nil, nil)
+	if resp, err = makeHTTPQuery(req); err == nil {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals(byeJSON, data), "Unexpected error")
+	}
+
+	if err != nil {
+		testSuit.Fail("Unexpected error", err.Error())
+	}
+
+}
+
+func (testSuit *mockServerSuite) TestMostRecentStubWins() {
+	var err error
+	var resp *http.Response
+	oldJSON := []byte(`{"key":"hello","value":"old"}`)
+	newJSON := []byte(`{"key":"hello","value":"new"}`)
+
+	testSuit.mockServer.When(GET, "/v1/service/hello*").ThenReturn(oldJSON, 200)
+	testSuit.mockServer.When(GET, "/v1/service/hello*").ThenReturn(newJSON, 201)
+
+	req, _ := newHTTPRequest("GET", "http://localhost:8080/v1/service/hello/", nil, nil)
+	if resp, err = makeHTTPQuery(req); err == nil {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals(newJSON, data), "Unexpected error")
+		assert.Equal(testSuit.T(), 201, resp.StatusCode)
+	}
+
+	if err != nil {
+		testSuit.Fail("Unexpected error", err.Error())
+	}
+
+}
+
+func (testSuit *mockServerSuite) TestJSONBody() {
+	aliceJSON := []byte(`{"id":"1","name":"Alice"}`)
+	bobJSON := []byte(`{"id":"2","name":"Bob"}`)
+
+	testSuit.mockServer.When(POST, "/v1/users").WithJSONBody([]byte(`{"name":"Alice","time":1}`), "/time").ThenReturn(aliceJSON, 201)
+	testSuit.mockServer.When(POST, "/v1/users").WithJSONBody([]byte(`{"name":"Bob"}`)).ThenReturn(bobJSON, 201)
+
+	bodies := map[string][]byte{
+		`{"time":1294706395881547000, "name":"Alice"}`: aliceJSON,
+		`{ "name" : "Bob" }`:                           bobJSON,
+	}
+	for inbound, outbound := range bodies {
+		req, _ := newHTTPRequest("POST", "http://localhost:8080/v1/users", []byte(inbound), nil)
+		resp, err := makeHTTPQuery(req)
+		if err != nil {
+			testSuit.Fail("Unexpected error", err.Error())
+			continue
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Nil(testSuit.T(), testSuit.jsonAssert.AssertJsonEquals(outbound, data), "Unexpected error")
+	}
+
+	assert.Nil(testSuit.T(), testSuit.mockServer.Verify(POST, "/v1/users").Times(2))
+}
+
+func (testSuit *mockServerSuite) TestVerify() {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+	inboundJSON := []byte(`{"key":"hi"}`)
+
+	testSuit.mockServer.When(GET, "/users/.*").ThenReturn(outboundJSON, 200)
+	testSuit.mockServer.When(POST, "/users/.*").ThenReturn(outboundJSON, 201)
+
+	for _, path := range []string{"/users/pjgg", "/users/octocat?page=2"} {
+		req, _ := newHTTPRequest("GET", "http://localhost:8080"+path, nil, nil)
+		if _, err := makeHTTPQuery(req); err != nil {
+			testSuit.Fail("Unexpected error", err.Error())
+		}
+	}
+	req, _ := newHTTPRequest("POST", "http://localhost:8080/users/pjgg", inboundJSON, nil)
+	req.Header.Add("X-Request-Id", "42")
+	if _, err := makeHTTPQuery(req); err != nil {
+		testSuit.Fail("Unexpected error", err.Error())
+	}
+
+	assert.Nil(testSuit.T(), testSuit.mockServer.Verify(GET, "/users/.*").Times(2))
+	assert.Nil(testSuit.T(), testSuit.mockServer.Verify(GET, "/users/.*").AtLeast(1))
+	assert.Nil(testSuit.T(), testSuit.mockServer.Verify(DELETE, "/users/.*").Never())
+
+	err := testSuit.mockServer.Verify(POST, "/users/.*").Never()
+	if assert.Error(testSuit.T(), err) {
+		assert.Contains(testSuit.T(), err.Error(), "Expected POST /users/.* to be called 0 times, but was called 1 times")
+		assert.Contains(testSuit.T(), err.Error(), "GET /users/octocat?page=2 (matched GET /users/.*")
+	}
+
+	requests := testSuit.mockServer.Requests()
+	if assert.Len(testSuit.T(), requests, 3) {
+		assert.Equal(testSuit.T(), "POST", requests[2].Method)
+		assert.Equal(testSuit.T(), "/users/pjgg", requests[2].Path)
+		assert.Equal(testSuit.T(), "42", requests[2].Header.Get("X-Request-Id"))
+		assert.Equal(testSuit.T(), inboundJSON, requests[2].Body)
+		assert.Equal(testSuit.T(), "POST /users/.*", requests[2].MatchedStub)
+		assert.False(testSuit.T(), requests[2].Timestamp.IsZero())
+	}
+
+	testSuit.mockServer.CleanStub()
+	assert.Empty(testSuit.T(), testSuit.mockServer.Requests())
+}
+
+// TestConcurrentStubStore must be run with -race, it adds and removes stubs while requests are in flight.
+func TestConcurrentStubStore(t *testing.T) {
+	const workers = 8
+	const iterations = 50
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+	concurrentServer := New()
+	if err := concurrentServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer concurrentServer.Close()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(3)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				stub := concurrentServer.When(GET, "/v1/service/{id:int}").ThenReturn(outboundJSON, 200)
+				stub.WithHeaderMatcher("X-Worker", Absent()).WithResponseHeader("X-Worker", strconv.Itoa(worker))
+				stub.InScenario("stress").WithDelay(time.Microsecond).ThenReturn(outboundJSON, 201)
+				if i%10 == 0 {
+					concurrentServer.CleanStub()
+				}
+			}
+		}(worker)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				resp, err := http.Get(concurrentServer.URL() + "/v1/service/" + strconv.Itoa(i))
+				if assert.Nil(t, err) {
+					ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				concurrentServer.Verify(GET, "/v1/service/{id:int}").AtLeast(0)
+				concurrentServer.Requests()
+				concurrentServer.OnUnmatched(NotFound())
+				concurrentServer.DefaultDelay(nil)
+				concurrentServer.ScenarioState("stress")
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Nil(t, concurrentServer.Verify(GET, "/v1/service/{id:int}").AtLeast(0))
+}
+
+func TestJournalCleanedInFlight(t *testing.T) {
+	var requests journal
+	stub := &stubReturn{method: GET, pathExpr: "/v1/users"}
+	inFlight := requests.record(httptest.NewRequest("GET", "/v1/users", nil), "/v1/users")
+	requests.clean()
+	requests.record(httptest.NewRequest("GET", "/v1/status", nil), "/v1/status")
+
+	requests.matched(inFlight, stub, map[string]string{"login": "pjgg"})
+	requests.mismatched(inFlight, []string{"GET /v1/users: body mismatch"})
+
+	recorded := requests.snapshot()
+	if assert.Len(t, recorded, 1) {
+		assert.Equal(t, "/v1/status", recorded[0].Path)
+		assert.Empty(t, recorded[0].MatchedStub, "a request in flight while the journal is cleaned must not update a later request")
+		assert.Nil(t, recorded[0].PathParams)
+		assert.Nil(t, recorded[0].Mismatches)
+	}
+}
+
+func TestIndependentMockServers(t *testing.T) {
+	helloJSON := []byte(`{"key":"hello","value":"world"}`)
+	byeJSON := []byte(`{"key":"bye","value":"world"}`)
+
+	helloServer := New(8181)
+	byeServer := New(8182)
+	helloServer.When(GET, "/v1/service*").ThenReturn(helloJSON, 200)
+	byeServer.When(GET, "/v1/service*").ThenReturn(byeJSON, 202)
+
+	helloRecorder := httptest.NewRecorder()
+	helloServer.ServeHTTP(helloRecorder, httptest.NewRequest("GET", "/v1/service/", nil))
+	byeRecorder := httptest.NewRecorder()
+	byeServer.ServeHTTP(byeRecorder, httptest.NewRequest("GET", "/v1/service/", nil))
+
+	assert.Equal(t, 200, helloRecorder.Code)
+	assert.Equal(t, string(helloJSON), helloRecorder.Body.String())
+	assert.Equal(t, 202, byeRecorder.Code)
+	assert.Equal(t, string(byeJSON), byeRecorder.Body.String())
+	assert.Equal(t, "http://localhost:8181", helloServer.URL())
+	assert.Equal(t, "http://localhost:8182", byeServer.URL())
+
+	assert.Nil(t, helloServer.Start())
+	assert.Nil(t, helloServer.Close())
+	assert.Nil(t, byeServer.Close())
+}
+
+func TestEphemeralPort(t *testing.T) {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+	ephemeralServer := New()
+	defer ephemeralServer.Close()
+
+	if err := ephemeralServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ephemeralServer.When(GET, "/v1/service/hello*").ThenReturn(outboundJSON, 200)
+
+	assert.NotEqual(t, "http://localhost:0", ephemeralServer.URL())
+	assert.NotEmpty(t, ephemeralServer.Addr())
+
+	req, _ := newHTTPRequest("GET", ephemeralServer.URL()+"/v1/service/hello/", nil, nil)
+	resp, err := makeHTTPQuery(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, string(outboundJSON), string(data))
+}
+
+func TestPortAlreadyInUse(t *testing.T) {
+	firstServer := New()
+	defer firstServer.Close()
+	if err := firstServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	secondServer := New(firstServer.(*MockServer).Port)
+	err := secondServer.Start()
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can't listen over port")
+}
+
+func TestHostAndShutdown(t *testing.T) {
+	mockServer := New()
+	if err := mockServer.SetHost("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mockServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, mockServer.SetHost("0.0.0.0"), "the host can't change once started")
+	mockServer.When(GET, "^/v1/slow$").WithDelay(200*time.Millisecond).ThenReturn([]byte("done"), 200)
+
+	assert.Equal(t, "http://127.0.0.1:"+strconv.Itoa(mockServer.(*MockServer).Port), mockServer.URL())
+	assert.Contains(t, mockServer.Addr(), "127.0.0.1:")
+
+	responses := make(chan string)
+	go func() {
+		resp, err := http.Get(mockServer.URL() + "/v1/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		responses <- string(data)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, mockServer.Shutdown(context.Background()))
+	assert.Equal(t, "done", <-responses, "Shutdown must wait for the active requests")
+	assert.Empty(t, mockServer.Addr())
+	_, err := http.Get(mockServer.URL() + "/v1/slow")
+	assert.Error(t, err)
+}
+
+func TestSessions(t *testing.T) {
+	sharedServer := New()
+	if err := sharedServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// parallel subtests run once TestSessions returns, so the shared server is closed at cleanup
+	t.Cleanup(func() { sharedServer.Close() })
+	sharedServer.When(GET, "/v1/service/hello").ThenReturn([]byte(`{"key":"shared"}`), 200)
+
+	t.Run("header", func(t *testing.T) {
+		t.Parallel()
+		session := sharedServer.NewSession()
+		defer session.Close()
+		session.When(GET, "/v1/service/hello").ThenReturn([]byte(`{"key":"header"}`), 201)
+
+		req, _ := newHTTPRequest("GET", sharedServer.URL()+"/v1/service/hello", nil, nil)
+		req.Header.Set(SessionHeader, session.ID())
+		resp, err := makeHTTPQuery(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, `{"key":"header"}`, string(data))
+		assert.Nil(t, session.Verify(GET, "/v1/service/hello").Times(1))
+	})
+
+	t.Run("path prefix", func(t *testing.T) {
+		t.Parallel()
+		session := sharedServer.NewSession()
+		defer session.Close()
+		session.When(GET, "/v1/service/hello").ThenReturn([]byte(`{"key":"prefix"}`), 202)
+
+		assert.Equal(t, sharedServer.URL()+"/_session/"+session.ID(), session.URL())
+		req, _ := newHTTPRequest("GET", session.URL()+"/v1/service/hello", nil, nil)
+		resp, err := makeHTTPQuery(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, 202, resp.StatusCode)
+		assert.Equal(t, `{"key":"prefix"}`, string(data))
+		assert.Nil(t, session.Verify(GET, "/v1/service/hello").Times(1))
+	})
+
+	t.Run("own port", func(t *testing.T) {
+		t.Parallel()
+		session := sharedServer.NewSession()
+		defer session.Close()
+		if err := session.Start(); err != nil {
+			t.Fatal(err)
+		}
+		session.When(GET, "/v1/service/hello").ThenReturn([]byte(`{"key":"port"}`), 203)
+
+		assert.NotEqual(t, sharedServer.URL(), session.URL())
+		req, _ := newHTTPRequest("GET", session.URL()+"/v1/service/hello", nil, nil)
+		resp, err := makeHTTPQuery(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, 203, resp.StatusCode)
+		assert.Equal(t, `{"key":"port"}`, string(data))
+	})
+
+	t.Run("clean", func(t *testing.T) {
+		t.Parallel()
+		cleaned := sharedServer.NewSession()
+		defer cleaned.Close()
+		untouched := sharedServer.NewSession()
+		defer untouched.Close()
+		cleaned.When(GET, "/v1/service/hello").ThenReturn(nil, 204)
+		untouched.When(GET, "/v1/service/hello").ThenReturn(nil, 204)
+
+		cleaned.CleanStub()
+
+		cleanedRecorder := httptest.NewRecorder()
+		sharedServer.ServeHTTP(cleanedRecorder, httptest.NewRequest("GET", "/_session/"+cleaned.ID()+"/v1/service/hello", nil))
+		untouchedRecorder := httptest.NewRecorder()
+		sharedServer.ServeHTTP(untouchedRecorder, httptest.NewRequest("GET", "/_session/"+untouched.ID()+"/v1/service/hello", nil))
+		assert.Equal(t, 404, cleanedRecorder.Code)
+		assert.Equal(t, 204, untouchedRecorder.Code)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+		session := sharedServer.NewSession()
+		session.When(GET, "/v1/service/hello").ThenReturn(nil, 204)
+		session.Close()
+
+		for _, req := range []*http.Request{
+			httptest.NewRequest("GET", "/v1/service/hello", nil),
+			httptest.NewRequest("GET", "/_session/"+session.ID()+"/v1/service/hello", nil),
+			httptest.NewRequest("GET", "/_session/unknown/v1/service/hello", nil),
+		} {
+			if req.URL.Path == "/v1/service/hello" {
+				req.Header.Set(SessionHeader, session.ID())
+			}
+			recorder := httptest.NewRecorder()
+			sharedServer.ServeHTTP(recorder, req)
+
+			var unmatched UnmatchedRequest
+			json.NewDecoder(recorder.Body).Decode(&unmatched)
+			assert.Equal(t, 404, recorder.Code, "a stale session must not be served the shared stubs")
+			assert.Contains(t, unmatched.Error, "unknown session ")
+		}
+	})
+}
+
+func TestTLS(t *testing.T) {
+	outboundJSON := []byte(`{"key":"hello","value":"world"}`)
+	tlsServer := New()
+	defer tlsServer.Close()
+	if err := tlsServer.EnableTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tlsServer.When(GET, "/v1/service/hello").ThenReturn(outboundJSON, 200)
+
+	assert.Regexp(t, "^https://localhost:", tlsServer.URL())
+	block, _ := pem.Decode(tlsServer.CACertPEM())
+	if assert.NotNil(t, block) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		assert.Nil(t, err)
+		assert.True(t, ca.IsCA)
+	}
+
+	resp, err := tlsServer.Client().Get(tlsServer.URL() + "/v1/service/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, string(outboundJSON), string(data))
+
+	resp, err = tlsServer.Client().Get("https://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(tlsServer.(*MockServer).Port)) + "/v1/service/hello")
+	if assert.Nil(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	_, err = http.Get(tlsServer.URL() + "/v1/service/hello")
+	assert.Error(t, err, "the default client must not trust the generated CA")
+
+	for name, enable := range map[string]func(MockServerBehavior) error{
+		"host then TLS": func(server MockServerBehavior) error {
+			server.SetHost("127.0.0.2")
+			return server.EnableTLS()
+		},
+		"TLS then host": func(server MockServerBehavior) error {
+			server.EnableTLS()
+			return server.SetHost("127.0.0.2")
+		},
+	} {
+		hostServer := New()
+		if err := enable(hostServer); err != nil {
+			t.Fatal(err)
+		}
+		if err := hostServer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		hostServer.When(GET, "/v1/service/hello").ThenReturn(outboundJSON, 200)
+		assert.Regexp(t, "^https://127.0.0.2:", hostServer.URL(), name)
+		resp, err = hostServer.Client().Get(hostServer.URL() + "/v1/service/hello")
+		if assert.Nil(t, err, name) {
+			assert.Equal(t, 200, resp.StatusCode, name)
+		}
+		hostServer.Close()
+	}
+
+	plainServer := New()
+	defer plainServer.Close()
+	if err := plainServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, plainServer.EnableTLS(), "TLS can't be enabled once started")
+	assert.Error(t, plainServer.EnableTLSFromFiles("cert.pem", "key.pem"), "TLS can't be enabled once started")
+	assert.Regexp(t, "^http://localhost:", plainServer.URL())
+	assert.Nil(t, plainServer.CACertPEM())
+}
+
+func TestTLSFromFiles(t *testing.T) {
+	generated, err := generateCertificates("mock.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, append(generated.certPEM, generated.caPEM...), 0600)
+	ioutil.WriteFile(keyFile, generated.keyPEM, 0600)
+
+	tlsServer := New()
+	defer tlsServer.Close()
+	if err := tlsServer.EnableTLSFromFiles(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tlsServer.When(GET, "/v1/service/hello").ThenReturn(nil, 204)
+	assert.Equal(t, generated.caPEM, tlsServer.CACertPEM())
+
+	client := tlsServer.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.ServerName = "mock.example.com"
+	resp, err := client.Get(tlsServer.URL() + "/v1/service/hello")
+	if assert.Nil(t, err) {
+		assert.Equal(t, 204, resp.StatusCode)
+	}
+
+	assert.Error(t, New().EnableTLSFromFiles(filepath.Join(dir, "missing.pem"), keyFile))
+}
+
+func TestHTTP2(t *testing.T) {
+	for name, enableTLS := range map[string]bool{"tls": true, "h2c": false} {
+		t.Run(name, func(t *testing.T) {
+			h2Server := New()
+			defer h2Server.Close()
+			if enableTLS {
+				if err := h2Server.EnableTLS(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h2Server.EnableHTTP2(); err != nil {
+				t.Fatal(err)
+			}
+			if err := h2Server.Start(); err != nil {
+				t.Fatal(err)
+			}
+			assert.Error(t, h2Server.EnableHTTP2(), "HTTP/2 can't be enabled once started")
+			h2Server.When(GET, "/v1/service/hello").WithProtocol(HTTP2).WithDelay(50*time.Millisecond).ThenReturn(nil, 204)
+
+			client := h2Server.Client()
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := client.Get(h2Server.URL() + "/v1/service/hello")
+					if assert.Nil(t, err) {
+						assert.Equal(t, 204, resp.StatusCode)
+						assert.Equal(t, 2, resp.ProtoMajor)
+						resp.Body.Close()
+					}
+				}()
+			}
+			wg.Wait()
+
+			requests := h2Server.Requests()
+			if assert.Len(t, requests, 5) {
+				for _, request := range requests {
+					assert.Equal(t, HTTP2, request.Proto)
+					assert.Equal(t, requests[0].RemoteAddr, request.RemoteAddr, "requests must be multiplexed over one connection")
+				}
+			}
+
+			http1Client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: h2Server.CACertPool()}}}
+			resp, err := http1Client.Get(h2Server.URL() + "/v1/service/hello")
+			if assert.Nil(t, err) {
+				assert.Equal(t, 404, resp.StatusCode)
+				requests = h2Server.Requests()
+				assert.Equal(t, HTTP1, requests[len(requests)-1].Proto)
+				assert.Equal(t, []string{"GET /v1/service/hello: protocol expected HTTP/2.0 but was HTTP/1.1"}, requests[len(requests)-1].Mismatches)
+			}
+		})
+	}
+}
+
+func TestRecord(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "github")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		fmt.Fprintf(w, `{"path":%q,"query":%q,"body":%q}`, r.URL.Path, r.URL.RawQuery, body)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+
+	recordingServer := New()
+	recordingServer.OnUnmatched(Record(upstream.URL+"/api", dir))
+	recordingServer.When(GET, "^/v1/status$").ThenReturn(nil, 204)
+
+	recorder := httptest.NewRecorder()
+	recordingServer.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/users?page=2", bytes.NewBufferString("name=pjgg")))
+	assert.Equal(t, 201, recorder.Code)
+	assert.Equal(t, "github", recorder.Header().Get("X-Upstream"))
+	assert.Equal(t, `{"path":"/api/v1/users","query":"page=2","body":"name=pjgg"}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	recordingServer.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/users?page=2", bytes.NewBufferString("name=pjgg")))
+	assert.Equal(t, 201, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	recordingServer.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/status", nil))
+	assert.Equal(t, 204, recorder.Code)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Equal(t, []string{filepath.Join(dir, "POST_v1-users_1.json"), filepath.Join(dir, "POST_v1-users_2.json")}, files)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "POST_v1-users_1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(content), `"body": "name=pjgg"`)
+	var definition StubDefinition
+	if assert.Nil(t, json.Unmarshal(content, &definition)) {
+		assert.Equal(t, "POST", definition.Request.Method)
+		assert.Equal(t, "/v1/users", definition.Request.Path)
+		assert.Equal(t, map[string]MatcherDefinition{"page": {Values: []string{"2"}}}, definition.Request.Query)
+		if assert.NotNil(t, definition.Request.Body) && assert.NotNil(t, definition.Request.Body.EqualTo) {
+			assert.Equal(t, "name=pjgg", *definition.Request.Body.EqualTo)
+		}
+		assert.Equal(t, 201, definition.Response.Status)
+		assert.Equal(t, StringList{"github"}, definition.Response.Headers["X-Upstream"])
+		assert.Nil(t, jsonAsserter.AssertJsonEquals([]byte(`{"path":"/api/v1/users","query":"page=2","body":"name=pjgg"}`), definition.Response.JSONBody))
+	}
+
+	upstream.Close()
+	recorder = httptest.NewRecorder()
+	recordingServer.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/users", nil))
+	assert.Equal(t, 502, recorder.Code)
+
+	assert.Panics(t, func() { Record("api.github.com", dir) })
+}
+
+func TestPlayback(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-Call", strconv.Itoa(calls))
+		fmt.Fprintf(w, `{"call":%d}`, calls)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+
+	serve := func(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+		return recorder
+	}
+
+	recordingServer := New()
+	recordingServer.OnUnmatched(Record(upstream.URL, dir))
+	for i := 0; i < 10; i++ {
+		serve(recordingServer, "GET", "/v1/users?page=2", "")
+	}
+	serve(recordingServer, "POST", "/v1/users", `{"name":"pjgg","admin":false}`)
+	serve(recordingServer, "POST", "/v1/token", "grant_type=client_credentials")
+
+	playbackServer := New()
+	playbackServer.When(GET, "^/v1/status$").ThenReturn(nil, 204)
+	if err := playbackServer.Playback(dir, Strict); err != nil {
+		t.Fatal(err)
+	}
+
+	for call := 1; call <= 11; call++ {
+		recorder := serve(playbackServer, "GET", "/v1/users?page=2", "")
+		expected := call
+		if call > 10 {
+			expected = 10
+		}
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, fmt.Sprintf(`{"call":%d}`, expected), recorder.Body.String())
+		assert.Equal(t, strconv.Itoa(expected), recorder.Header().Get("X-Call"))
+	}
+	assert.Equal(t, `{"call":11}`, serve(playbackServer, "POST", "/v1/users", `{"admin":false,"name":"pjgg"}`).Body.String())
+	assert.Equal(t, 404, serve(playbackServer, "POST", "/v1/users", `{"admin":true,"name":"pjgg"}`).Code)
+	assert.Equal(t, `{"call":12}`, serve(playbackServer, "POST", "/v1/token", "grant_type=client_credentials").Body.String())
+	assert.Equal(t, 404, serve(playbackServer, "POST", "/v1/token", "grant_type=password").Code)
+	assert.Equal(t, 404, serve(playbackServer, "GET", "/v1/users?page=3", "").Code)
+	assert.Equal(t, 404, serve(playbackServer, "GET", "/v1/users?page=2&extra=1", "").Code, "a query param that was not recorded must not match")
+	assert.Equal(t, 404, serve(playbackServer, "GET", "/v1/users?page=2", "unexpected").Code, "a body must not match an empty recorded body")
+	assert.Equal(t, 404, serve(playbackServer, "POST", "/v1/token?scope=read", "grant_type=client_credentials").Code, "a query must not match a recording without query")
+	assert.Equal(t, 404, serve(playbackServer, "GET", "/v1/status", "").Code, "strict playback must not fall through to the stubs")
+
+	if err := playbackServer.Playback(dir, Lenient); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"call":1}`, serve(playbackServer, "GET", "/v1/users?page=2", "").Body.String(), "a new playback must rewind the sequences")
+	assert.Equal(t, 204, serve(playbackServer, "GET", "/v1/status", "").Code)
+
+	playbackServer.StopPlayback()
+	assert.Equal(t, 404, serve(playbackServer, "GET", "/v1/users?page=2", "").Code)
+	assert.Equal(t, 12, calls)
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"request":`), 0644)
+	err := playbackServer.Playback(dir, Strict)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "broken.json")
+	}
+}
+
+func TestPlaybackEscapedJSON(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"html_url":"https:\/\/github.com\/pjgg","emoji":"\ud83d\ude00"}`)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+
+	recordingServer := New()
+	recordingServer.OnUnmatched(Record(upstream.URL, dir))
+	recorder := httptest.NewRecorder()
+	recordingServer.ServeHTTP(recorder, httptest.NewRequest("GET", "/users/pjgg", nil))
+	assert.Equal(t, 200, recorder.Code)
+
+	playbackServer := New()
+	if err := playbackServer.Playback(dir, Strict); err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	playbackServer.ServeHTTP(recorder, httptest.NewRequest("GET", "/users/pjgg", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Nil(t, jsonAsserter.AssertJsonEquals([]byte(`{"html_url":"https://github.com/pjgg","emoji":"\ud83d\ude00"}`), recorder.Body.Bytes()))
+}
+
+func TestLoadStubs(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "users.yaml"), []byte(`
+- request:
+    method: GET
+    pathPattern: /v1/users/{login}
+    query:
+      page: 2
+    headers:
+      Authorization:
+        matches: ^Bearer \w+$
+      X-Debug:
+        absent: true
+  response:
+    headers:
+      Content-Type: application/vnd.users+json
+      X-Tags: [a, b]
+    bodyFile: bodies/user.json
+- request:
+    method: POST
+    path: /v1/users
+    jsonBody:
+      name: pjgg
+      id: 1
+    ignorePaths: [/id]
+  response:
+    status: 201
+    jsonBody: {created: true}
+`), 0644)
+	os.Mkdir(filepath.Join(dir, "bodies"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "bodies", "user.json"), []byte(`{"login":"pjgg"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "status.yml"), []byte(`request: {method: GET, path: /v1/status}
+response: {body: up}
+---
+- request: {method: GET, path: /v1/health}
+  response: {body: healthy}
+---
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "token.json"), []byte(`{
+  "request": {"method": "POST", "path": "/v1/token", "body": {"contains": "grant_type=client_credentials"}},
+  "response": {"body": "token"}
+}`), 0644)
+
+	serve := func(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	mockServer := New()
+	if err := mockServer.LoadStubs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/v1/users/pjgg?page=2", nil)
+	r.Header.Set("Authorization", "Bearer abc123")
+	recorder := serve(mockServer, r)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, `{"login":"pjgg"}`, recorder.Body.String())
+	assert.Equal(t, "application/vnd.users+json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, []string{"a", "b"}, recorder.Header()["X-Tags"])
+	r.Header.Set("X-Debug", "true")
+	assert.Equal(t, 404, serve(mockServer, r).Code)
+
+	recorder = serve(mockServer, httptest.NewRequest("POST", "/v1/users", bytes.NewBufferString(`{"id":7,"name":"pjgg"}`)))
+	assert.Equal(t, 201, recorder.Code)
+	assert.Equal(t, `{"created":true}`, recorder.Body.String())
+	assert.Equal(t, 404, serve(mockServer, httptest.NewRequest("POST", "/v1/users/", bytes.NewBufferString(`{"name":"pjgg"}`))).Code)
+	assert.Equal(t, "token", serve(mockServer, httptest.NewRequest("POST", "/v1/token", bytes.NewBufferString("scope=read&grant_type=client_credentials"))).Body.String())
+	assert.Equal(t, "token", serve(mockServer, httptest.NewRequest("POST", "/v1/token?client=web", bytes.NewBufferString("grant_type=client_credentials"))).Body.String(), "path must match the path only")
+	assert.Equal(t, 201, serve(mockServer, httptest.NewRequest("POST", "/v1/users?dryRun=false", bytes.NewBufferString(`{"name":"pjgg"}`))).Code)
+	assert.Equal(t, "up", serve(mockServer, httptest.NewRequest("GET", "/v1/status", nil)).Body.String())
+	assert.Equal(t, "healthy", serve(mockServer, httptest.NewRequest("GET", "/v1/health", nil)).Body.String(), "every document of a YAML file must be loaded")
+
+	invalid := filepath.Join(t.TempDir(), "invalid.yaml")
+	ioutil.WriteFile(invalid, []byte(`
+- request:
+    method: FETCH
+    path: /v1/users
+    header: {}
+  response:
+    status: 1000
+- request:
+    method: GET
+    query:
+      page: {equalTo: "2", contains: "2"}
+    headers:
+      Authorization: {matches: "["}
+  response: {}
+- request: {method: GET, path: /v1/status}
+  response: {body: ok, bodyFile: missing.json}
+`), 0644)
+	emptyServer := New()
+	err := emptyServer.LoadStubs(invalid)
+	stubFileErrors, ok := err.(StubFileErrors)
+	if assert.True(t, ok, "%v", err) {
+		lines := make([]int, len(stubFileErrors))
+		for i, stubFileError := range stubFileErrors {
+			lines[i] = stubFileError.Line
+			assert.Equal(t, invalid, stubFileError.File)
+		}
+		assert.Equal(t, []int{3, 5, 7, 9, 11, 13, 16, 16}, lines, err.Error())
+		assert.Contains(t, err.Error(), invalid+":3: unknown method FETCH")
+		assert.Contains(t, err.Error(), invalid+":5: unknown field header in request")
+		assert.Contains(t, err.Error(), invalid+":9: missing path or pathPattern")
+	}
+	assert.Equal(t, 404, serve(emptyServer, httptest.NewRequest("GET", "/v1/status", nil)).Code, "nothing must be loaded from an invalid file")
+
+	ioutil.WriteFile(invalid, []byte("request:\n  method: GET\n path: /\n"), 0644)
+	err = emptyServer.LoadStubs(invalid)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), invalid+":2: did not find expected key")
+	}
+	ioutil.WriteFile(invalid, []byte("request: {method: GET, path: /}\nresponse: {}\n---\nrequest: {method: GET}\nresponse: {}\n"), 0644)
+	err = emptyServer.LoadStubs(invalid)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), invalid+":4: missing path or pathPattern")
+	}
+	invalidJSON := filepath.Join(t.TempDir(), "invalid.json")
+	ioutil.WriteFile(invalidJSON, []byte("{\n  \"request\": {\"method\": \"GET\", \"path\": \"\\/v1\"},\n  \"response\": {\"status\": 200,}\n}\n"), 0644)
+	err = emptyServer.LoadStubs(invalidJSON)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), invalidJSON+":3: invalid character")
+	}
+	assert.Error(t, emptyServer.LoadStubs(filepath.Join(dir, "missing")))
+}
+
+func TestWatchStubs(t *testing.T) {
+	dir := t.TempDir()
+	stubFile := filepath.Join(dir, "status.yaml")
+	writeStub := func(content string) {
+		if err := ioutil.WriteFile(stubFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func(handler http.Handler, path string) string {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return strconv.Itoa(recorder.Code) + " " + recorder.Body.String()
+	}
+	writeStub("request: {method: GET, path: /v1/status}\nresponse: {body: up}\n")
+
+	mockServer := New()
+	defer mockServer.Close()
+	if err := mockServer.WatchStubs(dir, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	mockServer.When(GET, "^/v1/override$").ThenReturn([]byte("stub"), 200)
+	assert.Equal(t, "200 up", status(mockServer, "/v1/status"))
+
+	writeStub("- request: {method: GET, path: /v1/status}\n  response: {body: degraded}\n" +
+		"- request: {method: GET, path: /v1/override}\n  response: {body: file}\n")
+	assert.Equal(t, "200 degraded", eventually(func() string { return status(mockServer, "/v1/status") }, "200 degraded"))
+	assert.Equal(t, "200 stub", status(mockServer, "/v1/override"), "the stubs added with When must win over the watched ones")
+
+	writeStub("request: {method: FETCH, path: /v1/status}\nresponse: {body: broken}\n")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "200 degraded", status(mockServer, "/v1/status"), "a wrong file must keep the previous stubs")
+
+	writeStub("request: {method: GET, path: /v1/status}\nresponse: {body: down, status: 503}\n")
+	assert.Equal(t, "503 down", eventually(func() string { return status(mockServer, "/v1/status") }, "503 down"))
+
+	mockServer.CleanStub()
+	assert.Equal(t, "503 down", status(mockServer, "/v1/status"))
+	mockServer.StopWatching()
+	assert.Equal(t, "404", status(mockServer, "/v1/status")[:3])
+
+	writeStub("request: {method: FETCH, path: /v1/status}\nresponse: {body: broken}\n")
+	assert.Error(t, mockServer.WatchStubs(dir, time.Second))
+	assert.Error(t, mockServer.WatchStubs(filepath.Join(dir, "missing"), time.Second))
+}
+
+func TestStubFilesPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "users.yaml"), []byte(`
+- request: {method: GET, pathPattern: /users/.*}
+  response: {body: generic}
+- request: {method: GET, path: /users/pjgg}
+  response: {body: specific}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "z_status.yaml"), []byte("request: {method: GET, path: /status}\nresponse: {body: last file}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a_status.yaml"), []byte("request: {method: GET, path: /status}\nresponse: {body: first file}\n"), 0644)
+
+	body := func(handler http.Handler, target string) string {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder.Body.String()
+	}
+
+	loaded := New()
+	if err := loaded.LoadStubs(dir); err != nil {
+		t.Fatal(err)
+	}
+	watched := New()
+	defer watched.Close()
+	if err := watched.WatchStubs(dir, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mockServer := range []MockServerBehavior{loaded, watched} {
+		assert.Equal(t, "specific", body(mockServer, "/users/pjgg"), "the last stub of a file must win")
+		assert.Equal(t, "generic", body(mockServer, "/users/octocat"))
+		assert.Equal(t, "last file", body(mockServer, "/status"), "the stubs of the last file must win")
+	}
+}
+
 func TestMockServerSuite(t *testing.T) {
 	testSuit := new(mockServerSuite)
 	testSuit.mockServer = Instance(mockServerPort)
@@ -132,6 +1568,14 @@ func TestMockServerSuite(t *testing.T) {
 	suite.Run(t, testSuit)
 }
 
+type testReporter struct {
+	errors []string
+}
+
+func (reporter *testReporter) Errorf(format string, args ...interface{}) {
+	reporter.errors = append(reporter.errors, fmt.Sprintf(format, args...))
+}
+
 type mockServerSuite struct {
 	suite.Suite
 	mockServer StubAction
@@ -151,6 +1595,17 @@ func newHTTPRequest(method, url string, body []byte, cookie *http.Cookie) (*http
 	return req, err
 }
 
+// eventually poll value until it returns expected, for one second at most, and return its last value.
+func eventually(value func() string, expected string) (actual string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if actual = value(); actual == expected {
+			return
+		}
+	}
+
+	return value()
+}
+
 func makeHTTPQuery(req *http.Request) (*http.Response, error) {
 
 	client := &http.Client{}
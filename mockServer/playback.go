@@ -0,0 +1,107 @@
+package mockServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// PlaybackMode define what happens with the requests that were not recorded.
+type PlaybackMode int
+
+const (
+	// Strict ... only the recordings are served, a request that was not recorded goes to the UnmatchedPolicy.
+	Strict PlaybackMode = iota
+	// Lenient ... a request that was not recorded falls through to the regular stubs.
+	Lenient
+)
+
+var recordingName = regexp.MustCompile(`^(.*)_(\d+)\.json$`)
+
+// Playback serve the interactions recorded in dir, see Record. A recording matches a request with the same method, path, query params and body, as any StubDefinition file in dir: a request with a query param that was not recorded, or with a body when the recorded one was empty, doesn't match. When the same request was recorded several times its responses are returned in sequence, in the order they were recorded.
+// Calling Playback again replaces the recordings and rewinds their sequences.
+func (mockServer *MockServer) Playback(dir string, mode PlaybackMode) error {
+	recordings, err := loadRecordings(dir)
+	if err != nil {
+		return err
+	}
+
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.recordings = recordings
+	mockServer.playbackMode = mode
+	mockServer.playback = true
+	return nil
+}
+
+// StopPlayback ... the recordings are no longer served, only the regular stubs.
+func (mockServer *MockServer) StopPlayback() {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.recordings = nil
+	mockServer.playback = false
+}
+
+func loadRecordings(dir string) (recordings []*stubReturn, err error) {
+	files, err := stubFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Mock server can't load the recordings of %s: %s", dir, err.Error())
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return recordedBefore(filepath.Base(files[i]), filepath.Base(files[j]))
+	})
+
+	var stubFileErrors StubFileErrors
+	byRequest := make(map[string]*stubReturn)
+	for _, file := range files {
+		definitions, lines, fileErrors := readStubFile(file)
+		stubFileErrors = append(stubFileErrors, fileErrors...)
+		for i, definition := range definitions {
+			request, _ := json.Marshal(definition.Request)
+			stub, ok := byRequest[string(request)]
+			if !ok {
+				if stub, err = definition.Request.stub(); err != nil {
+					stubFileErrors = append(stubFileErrors, &StubFileError{File: file, Line: lines[i], Message: err.Error()})
+					continue
+				}
+				exactRequest(stub)
+				byRequest[string(request)] = stub
+				recordings = append(recordings, stub)
+			}
+			response, err := definition.Response.stubResponse(filepath.Dir(file))
+			if err != nil {
+				stubFileErrors = append(stubFileErrors, &StubFileError{File: file, Line: lines[i], Message: err.Error()})
+				continue
+			}
+			stub.thenResponse(response)
+		}
+	}
+
+	if len(stubFileErrors) > 0 {
+		return nil, stubFileErrors
+	}
+	return recordings, nil
+}
+
+// exactRequest make a recording match only the request as it was recorded: no other query param, and an empty body if the recorded body was empty.
+func exactRequest(stub *stubReturn) {
+	stub.exactQuery = true
+	if stub.body == nil && stub.jsonBody == nil {
+		stub.body = EqualTo("")
+	}
+}
+
+// recordedBefore sort the recordings of the same request by their sequence number, so GET_users_2.json goes before GET_users_10.json
+func recordedBefore(a string, b string) bool {
+	aMatch, bMatch := recordingName.FindStringSubmatch(a), recordingName.FindStringSubmatch(b)
+	if aMatch == nil || bMatch == nil || aMatch[1] != bMatch[1] {
+		return a < b
+	}
+
+	aSequence, _ := strconv.Atoi(aMatch[2])
+	bSequence, _ := strconv.Atoi(bMatch[2])
+	return aSequence < bSequence
+}
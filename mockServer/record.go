@@ -0,0 +1,159 @@
+package mockServer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// hopByHopHeaders belong to a single connection, so they are neither forwarded nor recorded. Accept-Encoding is dropped too, so the upstream bodies are recorded uncompressed.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Accept-Encoding",
+	"Content-Length",
+}
+
+var notSlug = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+type recorder struct {
+	upstream *url.URL
+	dir      string
+	client   *http.Client
+	// mutex serialize the file names choice, so two recordings never get the same file.
+	mutex sync.Mutex
+}
+
+// Record forward the unmatched requests to the upstream base URL, ex https://api.github.com, and save every request/response pair as a StubDefinition JSON file in dir, ex OnUnmatched(Record("https://api.github.com", "testdata/github")).
+// Upstream failures are answered with a 502. Record panics if the upstream is not an absolute URL.
+func Record(upstream string, dir string) UnmatchedPolicy {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+		panic(fmt.Sprintf("Record upstream must be an absolute URL, but was %q", upstream))
+	}
+
+	recorder := &recorder{
+		upstream: upstreamURL,
+		dir:      dir,
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+	return recorder.record
+}
+
+func (recorder *recorder) record(w http.ResponseWriter, r *http.Request, unmatched UnmatchedRequest) {
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+
+	target := *recorder.upstream
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawPath = ""
+	target.RawQuery = r.URL.RawQuery
+	upstreamRequest, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		badGateway(w, err)
+		return
+	}
+	upstreamRequest.Header = withoutHopByHop(r.Header)
+	upstreamRequest.Header.Del(SessionHeader)
+
+	upstreamResponse, err := recorder.client.Do(upstreamRequest)
+	if err != nil {
+		badGateway(w, err)
+		return
+	}
+	defer upstreamResponse.Body.Close()
+	responseBody, err := ioutil.ReadAll(upstreamResponse.Body)
+	if err != nil {
+		badGateway(w, err)
+		return
+	}
+	headers := withoutHopByHop(upstreamResponse.Header)
+
+	definition := StubDefinition{
+		Request: newRequestDefinition(r, body),
+		Response: ResponseDefinition{
+			Status:         upstreamResponse.StatusCode,
+			Headers:        make(map[string]StringList),
+			BodyDefinition: newBodyDefinition(responseBody),
+		},
+	}
+	for name, values := range headers {
+		definition.Response.Headers[name] = values
+	}
+	if err := recorder.save(definition); err != nil {
+		log.Printf("Mock server can't record %s %s: %s", r.Method, r.URL.Path, err.Error())
+	}
+
+	addHeaders(w.Header(), headers)
+	w.WriteHeader(upstreamResponse.StatusCode)
+	w.Write(responseBody)
+}
+
+// save write the definition in a new file named after the request, ex GET_users-pjgg_1.json. Existing files are never overwritten.
+func (recorder *recorder) save(definition StubDefinition) error {
+	content, err := json.MarshalIndent(definition, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(recorder.dir, 0755); err != nil {
+		return err
+	}
+
+	slug := strings.Trim(notSlug.ReplaceAllString(definition.Request.Path, "-"), "-")
+	if slug == "" {
+		slug = "root"
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	for n := 1; ; n++ {
+		name := filepath.Join(recorder.dir, fmt.Sprintf("%s_%s_%d.json", definition.Request.Method, slug, n))
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(append(content, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+}
+
+func withoutHopByHop(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+
+	return header
+}
+
+func badGateway(w http.ResponseWriter, err error) {
+	body, _ := json.Marshal(map[string]string{"error": "Upstream request failed: " + err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write(body)
+}
@@ -0,0 +1,113 @@
+package mockServer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ScenarioStarted is the state of every scenario until one of its stubs moves it to a new state.
+const ScenarioStarted = "Started"
+
+// scenarios hold the current state of every named scenario, a scenario that never moved is in ScenarioStarted.
+type scenarios struct {
+	mutex  sync.Mutex
+	states map[string]string
+}
+
+func (scenarios *scenarios) state(name string) string {
+	scenarios.mutex.Lock()
+	defer scenarios.mutex.Unlock()
+	if state, ok := scenarios.states[name]; ok {
+		return state
+	}
+
+	return ScenarioStarted
+}
+
+func (scenarios *scenarios) setState(name string, state string) {
+	scenarios.mutex.Lock()
+	defer scenarios.mutex.Unlock()
+	if scenarios.states == nil {
+		scenarios.states = make(map[string]string)
+	}
+	scenarios.states[name] = state
+}
+
+// transition move the scenario from one state to another, only if it is still in the from state. Two concurrent requests can't both move a scenario out of the same state.
+func (scenarios *scenarios) transition(name string, from string, to string) bool {
+	scenarios.mutex.Lock()
+	defer scenarios.mutex.Unlock()
+	current, ok := scenarios.states[name]
+	if !ok {
+		current = ScenarioStarted
+	}
+	if from != "" && current != from {
+		return false
+	}
+	if to != "" {
+		if scenarios.states == nil {
+			scenarios.states = make(map[string]string)
+		}
+		scenarios.states[name] = to
+	}
+
+	return true
+}
+
+func (scenarios *scenarios) reset() {
+	scenarios.mutex.Lock()
+	defer scenarios.mutex.Unlock()
+	scenarios.states = nil
+}
+
+// checkScenario return why the stub is not eligible in the current state of its scenario.
+func (mockServer *MockServer) checkScenario(stub *stubReturn) (failure string) {
+	if stub.scenario == "" || stub.requiredState == "" {
+		return
+	}
+
+	if state := mockServer.scenarios.state(stub.scenario); state != stub.requiredState {
+		failure = fmt.Sprintf("scenario %s expected state %s but was %s", stub.scenario, stub.requiredState, state)
+	}
+
+	return
+}
+
+// ScenarioState return the current state of the scenario, ScenarioStarted if none of its stubs moved it yet.
+func (mockServer *MockServer) ScenarioState(scenario string) string {
+	return mockServer.scenarios.state(scenario)
+}
+
+// SetScenarioState move the scenario to state, ex in order to start a test in the middle of a workflow.
+func (mockServer *MockServer) SetScenarioState(scenario string, state string) {
+	mockServer.scenarios.setState(scenario, state)
+}
+
+// ResetScenarios move all the scenarios back to ScenarioStarted.
+func (mockServer *MockServer) ResetScenarios() {
+	mockServer.scenarios.reset()
+}
+
+// InScenario add the stub to a named scenario, a state machine shared by all its stubs. See WhenStateIs and WillSetStateTo.
+func (mockServer *stubReturn) InScenario(scenario string) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.scenario = scenario
+	return mockServer
+}
+
+// WhenStateIs is used in order to add a precondition over the scenario state, the stub is only eligible when its scenario is in state.
+func (mockServer *stubReturn) WhenStateIs(state string) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.requiredState = state
+	return mockServer
+}
+
+// WillSetStateTo move the stub scenario to state each time the stub serves a request.
+func (mockServer *stubReturn) WillSetStateTo(state string) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.newState = state
+	return mockServer
+}
@@ -0,0 +1,73 @@
+package mockServer
+
+import (
+	"net/http"
+)
+
+// SequencePolicy define what a stub answers once all its responses were returned.
+type SequencePolicy int
+
+const (
+	// RepeatLast ... keep returning the last response, the default policy.
+	RepeatLast SequencePolicy = iota
+	// Cycle ... start again from the first response.
+	Cycle
+	// FallThrough ... the stub stops matching, so the request goes to the next matching stub.
+	FallThrough
+)
+
+// stubResponse is one of the responses of a stub, a canned one or a computed one.
+type stubResponse struct {
+	thenReturn []byte
+	status     int
+	headers    http.Header
+	responder  Responder
+	handler    http.Handler
+	templated  bool
+	fault      Fault
+}
+
+func (mockServer *stubReturn) thenResponse(response *stubResponse) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.responses = append(mockServer.responses, response)
+	return mockServer
+}
+
+// nextResponse return the response for the current call, or why the stub can't serve it: the stub is exhausted and must fall through, or its scenario moved meanwhile.
+// The scenario moves to its new state only when the stub serves the request. It is safe under concurrent requests, each call gets its own position in the sequence.
+func (mockServer *stubReturn) nextResponse(scenarios *scenarios) (response *stubResponse, failure string) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+
+	response = &stubResponse{status: http.StatusOK}
+	if len(mockServer.responses) > 0 {
+		index := mockServer.calls
+		if index >= len(mockServer.responses) {
+			switch mockServer.exhausted {
+			case Cycle:
+				index = index % len(mockServer.responses)
+			case FallThrough:
+				return nil, "all the responses were returned"
+			default:
+				index = len(mockServer.responses) - 1
+			}
+		}
+		response = mockServer.responses[index]
+	}
+
+	if !scenarios.transition(mockServer.scenario, mockServer.requiredState, mockServer.newState) {
+		return nil, "scenario " + mockServer.scenario + " moved while the request was matched"
+	}
+	mockServer.calls++
+
+	return response, ""
+}
+
+// WhenExhausted define what the stub answers once all its responses were returned, ex When(GET, "/health").ThenReturn(nil, 503).ThenReturn(nil, 200).WhenExhausted(Cycle)
+func (mockServer *stubReturn) WhenExhausted(policy SequencePolicy) StubReturn {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.exhausted = policy
+	return mockServer
+}
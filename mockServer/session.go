@@ -0,0 +1,134 @@
+package mockServer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// SessionHeader is the header that routes a request to a Session, its value is the Session ID.
+const SessionHeader = "X-Mock-Session"
+
+// sessionPathPrefix is the path prefix that routes a request to a Session, ex /_session/3/users/pjgg
+const sessionPathPrefix = "/_session/"
+
+var lastSessionID int64
+
+// Session is a scope of a MockServer with its own stubs, recorded requests and scenarios, so t.Parallel() tests can share one MockServer. Cleaning a Session doesn't affect the others.
+// A request is routed to a Session by its SessionHeader, by its path prefix (see URL), or by a port of its own once the Session is started.
+type Session interface {
+	StubAction
+
+	ID() string
+	URL() string
+	Header() http.Header
+
+	Start() error
+	Close() error
+}
+
+type session struct {
+	*MockServer
+	id     string
+	parent *MockServer
+}
+
+// NewSession return a new Session of the MockServer. Don't forget to Close it at the end of your test.
+func (mockServer *MockServer) NewSession() Session {
+	newSession := &session{
+		MockServer: New().(*MockServer),
+		id:         strconv.FormatInt(atomic.AddInt64(&lastSessionID, 1), 10),
+		parent:     mockServer,
+	}
+	// the requests of a Session are never routed to another Session, even if they carry its SessionHeader
+	newSession.MockServer.inSession = true
+
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	if mockServer.sessions == nil {
+		mockServer.sessions = make(map[string]*session)
+	}
+	mockServer.sessions[newSession.id] = newSession
+
+	return newSession
+}
+
+// ID return the Session ID, the value of its SessionHeader.
+func (mockServer *session) ID() string {
+	return mockServer.id
+}
+
+// URL return the base URL of the Session: the URL of its own port if the Session was started, otherwise the MockServer URL plus the Session path prefix, ex http://localhost:8080/_session/3
+func (mockServer *session) URL() string {
+	if mockServer.MockServer.Addr() != "" {
+		return mockServer.MockServer.URL()
+	}
+
+	return mockServer.parent.URL() + sessionPathPrefix + mockServer.id
+}
+
+// Header return the headers that route a request to the Session, add them to your client requests.
+func (mockServer *session) Header() http.Header {
+	return http.Header{SessionHeader: {mockServer.id}}
+}
+
+// Close ... remove the Session from its MockServer, and close its own port if it was started.
+func (mockServer *session) Close() error {
+	mockServer.parent.mutex.Lock()
+	delete(mockServer.parent.sessions, mockServer.id)
+	mockServer.parent.mutex.Unlock()
+
+	return mockServer.MockServer.Close()
+}
+
+// routeSession return the Session that must serve the request, and the request as the Session must see it, without the Session path prefix.
+// It returns a nil Session if the request doesn't belong to any Session, and the unknown ID if it belongs to a Session that doesn't exist or was closed.
+func (mockServer *MockServer) routeSession(r *http.Request) (scope *session, sessionRequest *http.Request, unknownID string) {
+	mockServer.mutex.RLock()
+	defer mockServer.mutex.RUnlock()
+	if mockServer.inSession {
+		return nil, r, ""
+	}
+
+	if id := r.Header.Get(SessionHeader); id != "" {
+		if scope, ok := mockServer.sessions[id]; ok {
+			return scope, r, ""
+		}
+		return nil, r, id
+	}
+
+	if strings.HasPrefix(r.URL.Path, sessionPathPrefix) {
+		idAndPath := strings.SplitN(strings.TrimPrefix(r.URL.Path, sessionPathPrefix), "/", 2)
+		scope, ok := mockServer.sessions[idAndPath[0]]
+		if !ok {
+			return nil, r, idAndPath[0]
+		}
+
+		sessionRequest = new(http.Request)
+		*sessionRequest = *r
+		sessionURL := *r.URL
+		sessionURL.Path = "/"
+		if len(idAndPath) > 1 {
+			sessionURL.Path += idAndPath[1]
+		}
+		sessionURL.RawPath = ""
+		sessionRequest.URL = &sessionURL
+		return scope, sessionRequest, ""
+	}
+
+	return nil, r, ""
+}
+
+// unknownSession answer a request of a Session that doesn't exist or was closed with the UnmatchedPolicy, so a stale Session is never served the stubs of another scope.
+func (mockServer *MockServer) unknownSession(w http.ResponseWriter, r *http.Request, id string) {
+	fullPath := mockServer.fullPath(r)
+	failure := "unknown session " + id
+	entry := mockServer.journal.record(r, fullPath)
+	mockServer.journal.mismatched(entry, []string{failure})
+
+	_, unmatchedPolicy := mockServer.snapshot()
+	unmatched := newUnmatchedRequest(r, fullPath, nil)
+	unmatched.Error += ", " + failure
+	unmatchedPolicy(w, r, unmatched)
+}
@@ -0,0 +1,561 @@
+package mockServer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	stubFields     = []string{"request", "response"}
+	requestFields  = []string{"method", "path", "pathPattern", "query", "headers", "body", "jsonBody", "ignorePaths", "bodyBase64"}
+	responseFields = []string{"status", "headers", "body", "jsonBody", "bodyBase64", "bodyFile"}
+	matcherFields  = []string{"equalTo", "equalToIgnoreCase", "matches", "contains", "present", "absent", "values"}
+)
+
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// stubFileExtensions are the files loaded from a stub directory.
+var stubFileExtensions = map[string]bool{".json": true, ".yaml": true, ".yml": true}
+
+// StubFileError is a problem found in a stub file, at a given line.
+type StubFileError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (stubFileError *StubFileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", stubFileError.File, stubFileError.Line, stubFileError.Message)
+}
+
+// StubFileErrors are all the problems found in the stub files, one per line.
+type StubFileErrors []*StubFileError
+
+func (stubFileErrors StubFileErrors) Error() string {
+	messages := make([]string, len(stubFileErrors))
+	for i, stubFileError := range stubFileErrors {
+		messages[i] = stubFileError.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// LoadStubs load the stubs defined in a JSON or YAML file, or in all the .json, .yaml and .yml files of a directory. See StubDefinition for the format.
+// The files are validated before a single stub is added, so either all the stubs are loaded or none. The returned StubFileErrors tell the file and the line of every problem.
+// As with When, the last stub loaded wins, files are loaded by name and stubs in the order of their file.
+func (mockServer *MockServer) LoadStubs(path string) error {
+	stubs, err := readStubFiles(path)
+	if err != nil {
+		return err
+	}
+
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.stubs = append(stubs, mockServer.stubs...)
+	return nil
+}
+
+// stubFiles return the stub files of path, the file itself if it is not a directory.
+func stubFiles(path string) (files []string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && stubFileExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+
+	return
+}
+
+// readStubFiles read and validate all the stub files of path, and build their stubs. The stubs are returned last defined first, the order in which they are matched.
+func readStubFiles(path string) (stubs []*stubReturn, err error) {
+	files, err := stubFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("Mock server can't load the stubs of %s: %s", path, err.Error())
+	}
+
+	var stubFileErrors StubFileErrors
+	for _, file := range files {
+		definitions, lines, fileErrors := readStubFile(file)
+		stubFileErrors = append(stubFileErrors, fileErrors...)
+		for i, definition := range definitions {
+			stub, err := definition.stub(filepath.Dir(file))
+			if err != nil {
+				stubFileErrors = append(stubFileErrors, &StubFileError{File: file, Line: lines[i], Message: err.Error()})
+				continue
+			}
+			stubs = append(stubs, stub)
+		}
+	}
+
+	if len(stubFileErrors) > 0 {
+		return nil, stubFileErrors
+	}
+	for i, j := 0, len(stubs)-1; i < j; i, j = i+1, j-1 {
+		stubs[i], stubs[j] = stubs[j], stubs[i]
+	}
+	return
+}
+
+// readStubFile parse a file with one StubDefinition, or a list of them, and return the line of each one. A YAML file can hold several documents, each one a stub or a list of stubs.
+// The stubs are parsed into YAML nodes in order to know the lines, and then decoded as JSON so their numbers and strings are kept as they are.
+func readStubFile(file string) (definitions []StubDefinition, lines []int, stubFileErrors StubFileErrors) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, StubFileErrors{{File: file, Line: 0, Message: err.Error()}}
+	}
+
+	var roots []*yaml.Node
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		var stubFileError *StubFileError
+		if roots, stubFileError = jsonDocuments(file, content); stubFileError != nil {
+			return nil, nil, StubFileErrors{stubFileError}
+		}
+	} else {
+		roots, err = yamlDocuments(content)
+		if err != nil {
+			return nil, nil, StubFileErrors{yamlError(file, err)}
+		}
+	}
+
+	validator := &stubFileValidator{file: file, dir: filepath.Dir(file)}
+	var nodes []*yaml.Node
+	for _, root := range roots {
+		if root.Kind == yaml.SequenceNode {
+			nodes = append(nodes, root.Content...)
+		} else {
+			nodes = append(nodes, root)
+		}
+	}
+	for _, node := range nodes {
+		validator.stub(node)
+	}
+	if len(validator.errors) > 0 {
+		sort.SliceStable(validator.errors, func(i, j int) bool {
+			return validator.errors[i].Line < validator.errors[j].Line
+		})
+		return nil, nil, validator.errors
+	}
+
+	for _, node := range nodes {
+		var definition StubDefinition
+		if err := decodeStubNode(node, &definition); err != nil {
+			stubFileErrors = append(stubFileErrors, &StubFileError{File: file, Line: node.Line, Message: err.Error()})
+			continue
+		}
+		definitions = append(definitions, definition)
+		lines = append(lines, node.Line)
+	}
+
+	return
+}
+
+// yamlDocuments parse every document of a YAML file, separated by ---, and return their root nodes. The empty documents, as the one after a trailing ---, are skipped.
+func yamlDocuments(content []byte) (roots []*yaml.Node, err error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var document yaml.Node
+		if err = decoder.Decode(&document); err == io.EOF {
+			return roots, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(document.Content) > 0 && document.Content[0].ShortTag() != "!!null" {
+			roots = append(roots, document.Content[0])
+		}
+	}
+}
+
+// jsonDocuments parse a JSON file with encoding/json, as the YAML parser rejects some valid JSON escapes like \/, and return its value as a YAML node with the lines of the file.
+func jsonDocuments(file string, content []byte) ([]*yaml.Node, *StubFileError) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	root, err := jsonNode(decoder, content)
+	if err != nil {
+		return nil, jsonError(file, content, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, &StubFileError{File: file, Line: lineAt(content, decoder.InputOffset()), Message: "unexpected content after the top-level value"}
+	}
+
+	return []*yaml.Node{root}, nil
+}
+
+// jsonNode read the next JSON value of decoder into a YAML node, tagged as the YAML parser would tag it.
+func jsonNode(decoder *json.Decoder, content []byte) (*yaml.Node, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &yaml.Node{Kind: yaml.ScalarNode, Line: lineAt(content, decoder.InputOffset())}
+	switch token := token.(type) {
+	case json.Delim:
+		node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+		if token == '{' {
+			node.Kind, node.Tag = yaml.MappingNode, "!!map"
+		}
+		for decoder.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := jsonNode(decoder, content)
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, key)
+			}
+			value, err := jsonNode(decoder, content)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.Tag, node.Value = "!!str", token
+	case json.Number:
+		node.Tag, node.Value = "!!int", token.String()
+		if strings.ContainsAny(node.Value, ".eE") {
+			node.Tag = "!!float"
+		}
+	case bool:
+		node.Tag, node.Value = "!!bool", strconv.FormatBool(token)
+	case nil:
+		node.Tag, node.Value = "!!null", "null"
+	}
+
+	return node, nil
+}
+
+// lineAt return the line of the byte at offset, the first line is 1.
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+// jsonError turn a JSON parse error into a StubFileError, at the line of its offset.
+func jsonError(file string, content []byte, err error) *StubFileError {
+	if syntaxError, ok := err.(*json.SyntaxError); ok {
+		return &StubFileError{File: file, Line: lineAt(content, syntaxError.Offset), Message: err.Error()}
+	}
+	if err == io.ErrUnexpectedEOF {
+		return &StubFileError{File: file, Line: lineAt(content, int64(len(content))), Message: "unexpected end of JSON input"}
+	}
+
+	return &StubFileError{File: file, Line: 1, Message: err.Error()}
+}
+
+func yamlError(file string, err error) *StubFileError {
+	if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return &StubFileError{File: file, Line: line, Message: match[2]}
+	}
+
+	return &StubFileError{File: file, Line: 1, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+}
+
+// decodeStubNode decode the node through JSON, so the stub files and the recordings share the JSON decoding of StubDefinition.
+func decodeStubNode(node *yaml.Node, definition *StubDefinition) error {
+	content, err := json.Marshal(nodeValue(node))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, definition)
+}
+
+// nodeValue convert a YAML node into the value that encoding/json would decode. Numbers keep their text, so 1.10 is still 1.10
+func nodeValue(node *yaml.Node) interface{} {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		return nodeValue(node.Content[0])
+	case yaml.AliasNode:
+		return nodeValue(node.Alias)
+	case yaml.MappingNode:
+		value := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			value[node.Content[i].Value] = nodeValue(node.Content[i+1])
+		}
+		return value
+	case yaml.SequenceNode:
+		value := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			value[i] = nodeValue(item)
+		}
+		return value
+	}
+
+	switch node.ShortTag() {
+	case "!!null":
+		return nil
+	case "!!bool":
+		return node.Value == "true" || node.Value == "True" || node.Value == "TRUE"
+	case "!!int", "!!float":
+		if json.Valid([]byte(node.Value)) {
+			return json.Number(node.Value)
+		}
+	}
+
+	return node.Value
+}
+
+// stubFileValidator check a stub file against the StubDefinition format, and collect all its problems with their lines.
+type stubFileValidator struct {
+	file   string
+	dir    string
+	errors StubFileErrors
+}
+
+func (validator *stubFileValidator) fail(node *yaml.Node, format string, args ...interface{}) {
+	validator.errors = append(validator.errors, &StubFileError{File: validator.file, Line: node.Line, Message: fmt.Sprintf(format, args...)})
+}
+
+// fields return the fields of an object node, and fail for the unknown ones.
+func (validator *stubFileValidator) fields(node *yaml.Node, name string, allowed []string) map[string]*yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		validator.fail(node, "%s must be an object", name)
+		return nil
+	}
+
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if allowed != nil && !containsString(allowed, key.Value) {
+			validator.fail(key, "unknown field %s in %s, expected one of %s", key.Value, name, strings.Join(allowed, ", "))
+			continue
+		}
+		fields[key.Value] = node.Content[i+1]
+	}
+
+	return fields
+}
+
+func (validator *stubFileValidator) stub(node *yaml.Node) {
+	fields := validator.fields(node, "stub", stubFields)
+	if fields == nil {
+		return
+	}
+
+	if request, ok := fields["request"]; ok {
+		validator.request(request)
+	} else {
+		validator.fail(node, "missing request")
+	}
+	if response, ok := fields["response"]; ok {
+		validator.response(response)
+	} else {
+		validator.fail(node, "missing response")
+	}
+}
+
+func (validator *stubFileValidator) request(node *yaml.Node) {
+	fields := validator.fields(node, "request", requestFields)
+	if fields == nil {
+		return
+	}
+
+	if method, ok := fields["method"]; !ok {
+		validator.fail(node, "missing method")
+	} else if _, err := parseHTTPMethod(method.Value); err != nil || method.Kind != yaml.ScalarNode {
+		validator.fail(method, "unknown method %s, expected one of %s", method.Value, strings.Join(httpMethod[:], ", "))
+	}
+
+	path, hasPath := fields["path"]
+	pathPattern, hasPathPattern := fields["pathPattern"]
+	switch {
+	case hasPath && hasPathPattern:
+		validator.fail(pathPattern, "path and pathPattern can't be used together")
+	case hasPath:
+		validator.isString(path, "path")
+	case hasPathPattern:
+		if validator.isString(pathPattern, "pathPattern") {
+			if err := recovered(func() { compilePathExpr(pathPattern.Value) }); err != nil {
+				validator.fail(pathPattern, "invalid pathPattern: %s", err.Error())
+			}
+		}
+	default:
+		validator.fail(node, "missing path or pathPattern")
+	}
+
+	if query, ok := fields["query"]; ok {
+		for name, matcher := range validator.fields(query, "query", nil) {
+			validator.matcher(matcher, "query "+name)
+		}
+	}
+	if headers, ok := fields["headers"]; ok {
+		for name, matcher := range validator.fields(headers, "headers", nil) {
+			validator.matcher(matcher, "header "+name)
+		}
+	}
+
+	validator.exclusive(fields, "body", "jsonBody", "bodyBase64")
+	if body, ok := fields["body"]; ok {
+		validator.matcher(body, "body")
+	}
+	if ignorePaths, ok := fields["ignorePaths"]; ok {
+		if _, hasJSONBody := fields["jsonBody"]; !hasJSONBody {
+			validator.fail(ignorePaths, "ignorePaths needs a jsonBody")
+		}
+		validator.isStringList(ignorePaths, "ignorePaths")
+	}
+	if bodyBase64, ok := fields["bodyBase64"]; ok {
+		validator.base64(bodyBase64)
+	}
+}
+
+func (validator *stubFileValidator) response(node *yaml.Node) {
+	fields := validator.fields(node, "response", responseFields)
+	if fields == nil {
+		return
+	}
+
+	if status, ok := fields["status"]; ok {
+		if code, err := strconv.Atoi(status.Value); err != nil || status.Kind != yaml.ScalarNode || code < 100 || code > 599 {
+			validator.fail(status, "status must be a number between 100 and 599, but was %s", status.Value)
+		}
+	}
+	if headers, ok := fields["headers"]; ok {
+		for name, values := range validator.fields(headers, "headers", nil) {
+			if values.Kind == yaml.SequenceNode {
+				validator.isStringList(values, "header "+name)
+			} else {
+				validator.isString(values, "header "+name)
+			}
+		}
+	}
+
+	validator.exclusive(fields, "body", "jsonBody", "bodyBase64", "bodyFile")
+	if body, ok := fields["body"]; ok {
+		validator.isString(body, "body")
+	}
+	if bodyBase64, ok := fields["bodyBase64"]; ok {
+		validator.base64(bodyBase64)
+	}
+	if bodyFile, ok := fields["bodyFile"]; ok && validator.isString(bodyFile, "bodyFile") {
+		if _, err := os.Stat(relativeTo(validator.dir, bodyFile.Value)); err != nil {
+			validator.fail(bodyFile, "bodyFile %s can't be read: %s", bodyFile.Value, err.Error())
+		}
+	}
+}
+
+// matcher check a MatcherDefinition: a string, a list of strings or an object with exactly one matcher field.
+func (validator *stubFileValidator) matcher(node *yaml.Node, name string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return
+	case yaml.SequenceNode:
+		validator.isStringList(node, name)
+		return
+	}
+
+	fields := validator.fields(node, name, matcherFields)
+	if fields == nil {
+		return
+	}
+	if len(fields) != 1 {
+		validator.fail(node, "%s needs exactly one of %s", name, strings.Join(matcherFields, ", "))
+		return
+	}
+
+	for field, value := range fields {
+		switch field {
+		case "present", "absent":
+			if value.ShortTag() != "!!bool" || value.Value != "true" {
+				validator.fail(value, "%s %s must be true", name, field)
+			}
+		case "values":
+			validator.isStringList(value, name+" values")
+		case "matches":
+			if _, err := regexp.Compile(value.Value); err != nil {
+				validator.fail(value, "%s matches is not a valid regular expression: %s", name, err.Error())
+			}
+		default:
+			validator.isString(value, name+" "+field)
+		}
+	}
+}
+
+func (validator *stubFileValidator) exclusive(fields map[string]*yaml.Node, names ...string) {
+	var found []string
+	for _, name := range names {
+		if _, ok := fields[name]; ok {
+			found = append(found, name)
+		}
+	}
+	if len(found) > 1 {
+		validator.fail(fields[found[1]], "%s can't be used together", strings.Join(found, " and "))
+	}
+}
+
+func (validator *stubFileValidator) isString(node *yaml.Node, name string) bool {
+	if node.Kind != yaml.ScalarNode || node.ShortTag() == "!!null" {
+		validator.fail(node, "%s must be a string", name)
+		return false
+	}
+
+	return true
+}
+
+func (validator *stubFileValidator) isStringList(node *yaml.Node, name string) {
+	if node.Kind != yaml.SequenceNode {
+		validator.fail(node, "%s must be a list of strings", name)
+		return
+	}
+	for _, item := range node.Content {
+		validator.isString(item, name)
+	}
+}
+
+func (validator *stubFileValidator) base64(node *yaml.Node) {
+	if !validator.isString(node, "bodyBase64") {
+		return
+	}
+	if _, err := base64.StdEncoding.DecodeString(node.Value); err != nil {
+		validator.fail(node, "bodyBase64 is not valid base64: %s", err.Error())
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package mockServer
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type pathParamsKey struct{}
+
+// placeholder is a path template capture, ex {login} or {id:int}
+var placeholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::([a-z]+))?\}`)
+
+// captureTypes are the regular expressions of the typed captures, {name} is a string capture.
+var captureTypes = map[string]string{
+	"string": `[^/]+`,
+	"int":    `[0-9]+`,
+	"uuid":   `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	"path":   `.+`,
+}
+
+// isPathTemplate return true if pathExpr has at least one capture, ex /users/{login}
+func isPathTemplate(pathExpr string) bool {
+	return placeholder.MatchString(pathExpr)
+}
+
+// compilePathExpr compile pathExpr as a path template if it has captures, otherwise as a regular expression.
+func compilePathExpr(pathExpr string) (path *regexp.Regexp, pathTemplate bool) {
+	if isPathTemplate(pathExpr) {
+		return compilePathTemplate(pathExpr), true
+	}
+
+	return regexp.MustCompile(pathExpr), false
+}
+
+// compilePathTemplate translate a path template into an anchored regular expression with a named group per capture. It panics if a capture type is unknown, as regexp.MustCompile does.
+func compilePathTemplate(template string) *regexp.Regexp {
+	var expr []string
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(template, -1) {
+		name := template[loc[2]:loc[3]]
+		captureType := "string"
+		if loc[4] >= 0 {
+			captureType = template[loc[4]:loc[5]]
+		}
+		captureExpr, ok := captureTypes[captureType]
+		if !ok {
+			panic("mockServer: unknown capture type " + captureType + " in path template " + template)
+		}
+		expr = append(expr, regexp.QuoteMeta(template[last:loc[0]]), "(?P<"+name+">"+captureExpr+")")
+		last = loc[1]
+	}
+	expr = append(expr, regexp.QuoteMeta(template[last:]))
+
+	return regexp.MustCompile("^" + strings.Join(expr, "") + "$")
+}
+
+// pathParams return the captures of a path template, nil if the stub is not a path template.
+func (stub *stubReturn) pathParams(path string) (params map[string]string) {
+	if !stub.pathTemplate {
+		return
+	}
+
+	values := stub.path.FindStringSubmatch(path)
+	params = make(map[string]string)
+	for i, name := range stub.path.SubexpNames() {
+		if name != "" && i < len(values) {
+			params[name] = values[i]
+		}
+	}
+
+	return
+}
+
+func withPathParams(r *http.Request, params map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+}
+
+// PathParams return the values captured by the path template of the stub that is serving r, ex PathParams(r)["login"]. Use it inside a Responder or a ThenServe handler.
+func PathParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params
+}
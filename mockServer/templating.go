@@ -0,0 +1,130 @@
+package mockServer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+// TemplateData is the request data available to a response template, ex {{.PathParams.login}}, {{.Query.Get "page"}}, {{.Header.Get "X-Request-Id"}} or {{.JSON.user.name}}
+type TemplateData struct {
+	Method     string
+	Path       string
+	PathParams map[string]string
+	Query      url.Values
+	Header     http.Header
+	Body       string
+	// JSON is the request body decoded as JSON, nil if the body is not a JSON.
+	JSON interface{}
+}
+
+// templateFuncs are the helpers available to a response template.
+var templateFuncs = template.FuncMap{
+	// now return the current time formatted as RFC3339, or with the given layout, ex {{now "2006-01-02"}}
+	"now": func(layout ...string) string {
+		if len(layout) > 0 {
+			return time.Now().Format(layout[0])
+		}
+		return time.Now().Format(time.RFC3339)
+	},
+	// uuid return a random UUID version 4
+	"uuid": func() string {
+		uuid := make([]byte, 16)
+		rand.Read(uuid)
+		uuid[6] = (uuid[6] & 0x0f) | 0x40
+		uuid[8] = (uuid[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+	},
+	// randomInt return a random int between min (included) and max (excluded), ex {{randomInt 1 100}}
+	"randomInt": func(min, max int) int {
+		if max <= min {
+			return min
+		}
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(max-min)))
+		return min + int(n.Int64())
+	},
+	// base64 encode a string, ex {{base64 .PathParams.login}}
+	"base64": func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	},
+}
+
+func newTemplateData(r *http.Request) *TemplateData {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var jsonBody interface{}
+	if json.Unmarshal(body, &jsonBody) != nil {
+		jsonBody = nil
+	}
+
+	return &TemplateData{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		PathParams: PathParams(r),
+		Query:      r.URL.Query(),
+		Header:     r.Header,
+		Body:       string(body),
+		JSON:       jsonBody,
+	}
+}
+
+func render(name string, text string, data *TemplateData) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	return execute(tmpl, data)
+}
+
+func execute(tmpl *template.Template, data *TemplateData) (string, error) {
+	var rendered bytes.Buffer
+	err := tmpl.Execute(&rendered, data)
+
+	return rendered.String(), err
+}
+
+// templateResponder render the body template and the stub response headers with the request data. A render error is answered with a 500 that explains it.
+func (stub *stubReturn) templateResponder(bodyTemplate []byte, status int) Responder {
+	tmpl := template.Must(template.New(stub.String()).Funcs(templateFuncs).Parse(string(bodyTemplate)))
+	return func(r *http.Request) (int, http.Header, []byte) {
+		data := newTemplateData(r)
+		body, err := execute(tmpl, data)
+		if err != nil {
+			return http.StatusInternalServerError, nil, []byte("Mock server template error: " + err.Error())
+		}
+
+		stub.mutex.RLock()
+		responseHeaders := make(http.Header)
+		addHeaders(responseHeaders, stub.responseHeaders)
+		stub.mutex.RUnlock()
+
+		headers := make(http.Header)
+		for key, values := range responseHeaders {
+			for _, value := range values {
+				renderedValue, err := render(key, value, data)
+				if err != nil {
+					return http.StatusInternalServerError, nil, []byte("Mock server template error: " + err.Error())
+				}
+				headers.Add(key, renderedValue)
+			}
+		}
+
+		return status, headers, []byte(body)
+	}
+}
+
+// ThenReturnTemplate is the action that will be returned for a given precondition, rendering thenReturn and the response headers as text/template with the request TemplateData. Helpers now, uuid, randomInt and base64 are available.
+// It panics if thenReturn is not a valid template, as regexp.MustCompile does.
+func (mockServer *stubReturn) ThenReturnTemplate(thenReturn []byte, status int) StubReturn {
+	return mockServer.thenResponse(&stubResponse{responder: mockServer.templateResponder(thenReturn, status), templated: true})
+}
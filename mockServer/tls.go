@@ -0,0 +1,194 @@
+package mockServer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+// errTLSStarted is returned when TLS is enabled on a MockServer that is already serving plain http.
+var errTLSStarted = errors.New("Mock server can't enable TLS once started, call it before Start")
+
+// defaultHostnames are the names of the generated certificate when EnableTLS gets no hostname.
+var defaultHostnames = []string{"localhost", "127.0.0.1", "::1"}
+
+// certificates is a self-signed CA and a leaf certificate signed by it, everything PEM encoded.
+type certificates struct {
+	caPEM   []byte
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// generateCertificates build a new CA and a leaf certificate valid for the hostnames, IPs are added as IP SANs and the rest as DNS SANs.
+func generateCertificates(hostnames ...string) (generated certificates, err error) {
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"rest-in-peace"}, CommonName: "rest-in-peace mock CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * 365 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano() + 1),
+		Subject:      pkix.Name{Organization: []string{"rest-in-peace"}, CommonName: hostnames[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * 365 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, hostname := range hostnames {
+		if ip := net.ParseIP(hostname); ip != nil {
+			leafTemplate.IPAddresses = append(leafTemplate.IPAddresses, ip)
+		} else {
+			leafTemplate.DNSNames = append(leafTemplate.DNSNames, hostname)
+		}
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	leafKeyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		return
+	}
+
+	generated.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	generated.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	generated.keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: leafKeyDER})
+	return
+}
+
+// hostnamesOf return the default hostnames plus host, the address given to SetHost, unless it is empty or listens on all the interfaces.
+func hostnamesOf(host string) []string {
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return defaultHostnames
+	}
+	for _, hostname := range defaultHostnames {
+		if hostname == host {
+			return defaultHostnames
+		}
+	}
+
+	return append(append([]string{}, defaultHostnames...), host)
+}
+
+// newCertificate generate the certificates for the hostnames, and return the leaf one ready to serve with its PEM encoded CA.
+func newCertificate(hostnames ...string) (certificate tls.Certificate, caPEM []byte, err error) {
+	generated, err := generateCertificates(hostnames...)
+	if err != nil {
+		return certificate, nil, fmt.Errorf("Mock server can't generate its certificates: %s", err.Error())
+	}
+	certificate, err = tls.X509KeyPair(generated.certPEM, generated.keyPEM)
+	if err != nil {
+		return certificate, nil, fmt.Errorf("Mock server can't generate its certificates: %s", err.Error())
+	}
+
+	return certificate, generated.caPEM, nil
+}
+
+// EnableTLS ... the MockServer will serve https with a certificate signed by a CA generated on the fly, valid for the hostnames.
+// By default it is valid for localhost, 127.0.0.1, ::1 and the host given to SetHost. Use CACertPool or Client in order to trust it. Call it before Start, once started it returns an error.
+func (mockServer *MockServer) EnableTLS(hostnames ...string) error {
+	if mockServer.Addr() != "" {
+		return errTLSStarted
+	}
+
+	defaults := len(hostnames) == 0
+	if defaults {
+		mockServer.mutex.RLock()
+		hostnames = hostnamesOf(mockServer.host)
+		mockServer.mutex.RUnlock()
+	}
+
+	certificate, caPEM, err := newCertificate(hostnames...)
+	if err != nil {
+		return err
+	}
+	return mockServer.enableTLS(certificate, caPEM, defaults)
+}
+
+// EnableTLSFromFiles ... the MockServer will serve https with your own PEM encoded certificate and key. The last certificate of the certFile chain is taken as the CA, so a self-signed certificate or a chain ending in your CA are both fine. Call it before Start, once started it returns an error.
+func (mockServer *MockServer) EnableTLSFromFiles(certFile string, keyFile string) error {
+	if mockServer.Addr() != "" {
+		return errTLSStarted
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Mock server can't load its certificate %s: %s", certFile, err.Error())
+	}
+
+	caDER := certificate.Certificate[len(certificate.Certificate)-1]
+	return mockServer.enableTLS(certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), false)
+}
+
+// enableTLS check again that the MockServer is not started, under the same lock that Start takes. defaults tells that the certificate follows the host given to SetHost.
+func (mockServer *MockServer) enableTLS(certificate tls.Certificate, caPEM []byte, defaults bool) error {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	if mockServer.listener != nil {
+		return errTLSStarted
+	}
+
+	mockServer.tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	mockServer.caPEM = caPEM
+	mockServer.tlsDefault = defaults
+	return nil
+}
+
+// CACertPEM return the PEM encoded CA that signed the MockServer certificate, nil if TLS is not enabled.
+func (mockServer *MockServer) CACertPEM() []byte {
+	mockServer.mutex.RLock()
+	defer mockServer.mutex.RUnlock()
+	return mockServer.caPEM
+}
+
+// CACertPool return a pool with the CA that signed the MockServer certificate, ready to be used as RootCAs of your client tls.Config.
+func (mockServer *MockServer) CACertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if caPEM := mockServer.CACertPEM(); caPEM != nil {
+		pool.AppendCertsFromPEM(caPEM)
+	}
+	return pool
+}
+
+// Client return a new http.Client that trusts the MockServer CA, and talks HTTP/2 once it is enabled.
+func (mockServer *MockServer) Client() *http.Client {
+	rootCAs := mockServer.CACertPool()
+
+	mockServer.mutex.RLock()
+	defer mockServer.mutex.RUnlock()
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+			Protocols:       mockServer.clientProtocols(),
+		},
+	}
+}
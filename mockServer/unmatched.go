@@ -0,0 +1,124 @@
+package mockServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const maxNearMisses = 3
+
+// UnmatchedPolicy is the behavior of the MockServer when no stub match a request. See NotFound, DefaultResponse and FailTest.
+type UnmatchedPolicy func(w http.ResponseWriter, r *http.Request, unmatched UnmatchedRequest)
+
+// TestReporter is the part of testing.TB used by FailTest.
+type TestReporter interface {
+	Errorf(format string, args ...interface{})
+}
+
+// UnmatchedRequest explain why a request didn't match any stub.
+type UnmatchedRequest struct {
+	Error  string `json:"error"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// NearMisses are the closest stubs, ranked by their failed preconditions.
+	NearMisses []NearMiss `json:"nearMisses"`
+}
+
+// NearMiss is a stub that didn't match a request, with all the preconditions that failed: method, path, query param, header or body.
+type NearMiss struct {
+	Stub     string   `json:"stub"`
+	Failures []string `json:"failures"`
+}
+
+// distance weight the failed preconditions, a stub for another method or path is farther than a stub with a wrong header.
+func (nearMiss NearMiss) distance() (distance int) {
+	for _, failure := range nearMiss.Failures {
+		if strings.HasPrefix(failure, "method") || strings.HasPrefix(failure, "path") {
+			distance += 10
+		} else {
+			distance++
+		}
+	}
+
+	return
+}
+
+// newUnmatchedRequest rank the nearMisses from the closest to the farthest stub. Ties keep the stubs order, the most recent first.
+func newUnmatchedRequest(r *http.Request, fullPath string, nearMisses []NearMiss) UnmatchedRequest {
+	sort.SliceStable(nearMisses, func(i, j int) bool {
+		return nearMisses[i].distance() < nearMisses[j].distance()
+	})
+	if len(nearMisses) > maxNearMisses {
+		nearMisses = nearMisses[:maxNearMisses]
+	}
+
+	return UnmatchedRequest{
+		Error:      "No stub found for " + r.Method + " " + fullPath,
+		Method:     r.Method,
+		Path:       fullPath,
+		NearMisses: nearMisses,
+	}
+}
+
+// mismatches describe the near misses with the same method and path of the request.
+func mismatches(nearMisses []NearMiss) (mismatches []string) {
+	for _, nearMiss := range nearMisses {
+		if !strings.HasPrefix(nearMiss.Failures[0], "method") && !strings.HasPrefix(nearMiss.Failures[0], "path") {
+			mismatches = append(mismatches, nearMiss.Stub+": "+strings.Join(nearMiss.Failures, ", "))
+		}
+	}
+
+	return
+}
+
+func (unmatched UnmatchedRequest) String() string {
+	lines := []string{unmatched.Error}
+	if len(unmatched.NearMisses) == 0 {
+		lines = append(lines, "\tthere are no stubs defined")
+	}
+	for _, nearMiss := range unmatched.NearMisses {
+		lines = append(lines, fmt.Sprintf("\t%s: %s", nearMiss.Stub, strings.Join(nearMiss.Failures, ", ")))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// NotFound answer the unmatched requests with a 404 and a JSON UnmatchedRequest. It is the default UnmatchedPolicy.
+func NotFound() UnmatchedPolicy {
+	return func(w http.ResponseWriter, r *http.Request, unmatched UnmatchedRequest) {
+		body, _ := json.Marshal(unmatched)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(body)
+	}
+}
+
+// DefaultResponse answer the unmatched requests with the given body and status, as a stub catching everything.
+func DefaultResponse(body []byte, status int) UnmatchedPolicy {
+	return func(w http.ResponseWriter, r *http.Request, unmatched UnmatchedRequest) {
+		if len(body) > 0 {
+			w.Header().Set("Content-Type", contentType(body))
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// FailTest report the unmatched requests as a test error, ex FailTest(testSuit.T()), and answer them as NotFound.
+func FailTest(t TestReporter) UnmatchedPolicy {
+	notFound := NotFound()
+	return func(w http.ResponseWriter, r *http.Request, unmatched UnmatchedRequest) {
+		t.Errorf("%s", unmatched)
+		notFound(w, r, unmatched)
+	}
+}
+
+// OnUnmatched define the UnmatchedPolicy of the MockServer, NotFound by default.
+func (mockServer *MockServer) OnUnmatched(policy UnmatchedPolicy) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.unmatchedPolicy = policy
+}
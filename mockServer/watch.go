@@ -0,0 +1,135 @@
+package mockServer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type stubWatcher struct {
+	dir         string
+	interval    time.Duration
+	fingerprint string
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// WatchStubs load the stub files of dir, as LoadStubs does, and reload them every time a file of dir, or of its subdirectories as the body files, changes. The directory is polled every interval, so it behaves the same on every filesystem.
+// The new stubs replace the previous ones at once. If a file is wrong the previous stubs are kept and the errors are logged, fix the file and they are reloaded.
+// As with LoadStubs the last stub defined wins. The stubs added with When win over the watched ones. CleanStub keeps the watched stubs, see StopWatching. Calling WatchStubs again replaces the watched directory.
+func (mockServer *MockServer) WatchStubs(dir string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Mock server can't watch %s: the interval must be positive, but was %s", dir, interval)
+	}
+
+	fingerprint, err := stubDirFingerprint(dir)
+	if err != nil {
+		return fmt.Errorf("Mock server can't watch %s: %s", dir, err.Error())
+	}
+	stubs, err := readStubFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	watcher := &stubWatcher{
+		dir:         dir,
+		interval:    interval,
+		fingerprint: fingerprint,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	mockServer.mutex.Lock()
+	previous := mockServer.watcher
+	mockServer.watcher = watcher
+	mockServer.watched = stubs
+	mockServer.mutex.Unlock()
+
+	previous.close()
+	go mockServer.watch(watcher)
+	return nil
+}
+
+// StopWatching ... stop polling the watched directory and remove its stubs.
+func (mockServer *MockServer) StopWatching() {
+	mockServer.mutex.Lock()
+	watcher := mockServer.watcher
+	mockServer.watcher = nil
+	mockServer.watched = nil
+	mockServer.mutex.Unlock()
+
+	watcher.close()
+}
+
+func (mockServer *MockServer) watch(watcher *stubWatcher) {
+	defer close(watcher.done)
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+			mockServer.reload(watcher)
+		}
+	}
+}
+
+// reload the stubs of the watcher directory if any file changed since the last poll.
+func (mockServer *MockServer) reload(watcher *stubWatcher) {
+	fingerprint, err := stubDirFingerprint(watcher.dir)
+	if err != nil {
+		log.Printf("Mock server can't watch %s: %s", watcher.dir, err.Error())
+		return
+	}
+	if fingerprint == watcher.fingerprint {
+		return
+	}
+	// The fingerprint is kept even if the files are wrong, so the errors are logged once and not at every poll.
+	watcher.fingerprint = fingerprint
+
+	stubs, err := readStubFiles(watcher.dir)
+	if err != nil {
+		log.Printf("Mock server keeps the previous stubs of %s, they can't be reloaded:\n%s", watcher.dir, err.Error())
+		return
+	}
+
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	if mockServer.watcher == watcher {
+		mockServer.watched = stubs
+		log.Printf("Mock server reloaded %d stubs of %s", len(stubs), watcher.dir)
+	}
+}
+
+// close stop the polling and wait for it, so no reload happens once close returns. A nil stubWatcher does nothing.
+func (watcher *stubWatcher) close() {
+	if watcher == nil {
+		return
+	}
+
+	close(watcher.stop)
+	<-watcher.done
+}
+
+// stubDirFingerprint describe every file of dir by its name, size and modification time, so any change of a stub file or of a body file changes the fingerprint.
+func stubDirFingerprint(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano()))
+		}
+		return nil
+	})
+	sort.Strings(files)
+
+	return strings.Join(files, "\n"), err
+}